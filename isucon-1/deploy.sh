@@ -13,4 +13,4 @@ sudo systemctl daemon-reload
 sudo bash -c ":>/var/log/nginx/access.log"
 
 sudo systemctl restart nginx
-sudo systemctl restart isuumo.go
+sudo systemctl reload-or-restart isuumo.go
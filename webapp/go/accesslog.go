@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type dbTimerKey struct{}
+
+// dbTimer 1リクエストの中でDBにかかった時間の合計
+type dbTimer struct {
+	ns int64
+}
+
+func withDBTimer(ctx context.Context) (context.Context, *dbTimer) {
+	t := &dbTimer{}
+	return context.WithValue(ctx, dbTimerKey{}, t), t
+}
+
+// addDBTime ctxがリクエストのものであれば、そのリクエストのDB時間に足す
+func addDBTime(ctx context.Context, d time.Duration) {
+	if t, ok := ctx.Value(dbTimerKey{}).(*dbTimer); ok {
+		atomic.AddInt64(&t.ns, int64(d))
+	}
+}
+
+// rotatingFile maxSizeを超えたらpath.1, path.2, ...とずらして新しいファイルに書く
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.w = bufio.NewWriterSize(f, 64*1024)
+	r.size = st.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.w.Flush()
+	r.f.Close()
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if r.maxFiles > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.w.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	return r.f.Close()
+}
+
+// accessLogger ルートのテンプレート付きのアクセスログ。
+// LTSVはalpでそのまま集計でき、エンドポイントごとにまとめるなら alp ltsv --uri-label=route とする
+type accessLogger struct {
+	format string
+	out    io.Writer
+	flush  func() error
+	close  func() error
+}
+
+var accessLog *accessLogger
+
+// NewAccessLoggerFromEnv ACCESS_LOG_PATHが設定されていれば、ACCESS_LOG_FORMAT(ltsvかjson)で書き出す。
+// ACCESS_LOG_PATH=-なら標準出力に書く。ACCESS_LOG_MAX_MBを超えたらローテートし、ACCESS_LOG_MAX_FILES世代まで残す
+func NewAccessLoggerFromEnv() (*accessLogger, error) {
+	path := os.Getenv("ACCESS_LOG_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	format := getEnv("ACCESS_LOG_FORMAT", "ltsv")
+	if format != "ltsv" && format != "json" {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT: %s", format)
+	}
+	if path == "-" {
+		return &accessLogger{format: format, out: os.Stdout, flush: func() error { return nil }, close: func() error { return nil }}, nil
+	}
+
+	maxMB, err := strconv.Atoi(getEnv("ACCESS_LOG_MAX_MB", "100"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_MAX_MB: %v", err)
+	}
+	maxFiles, err := strconv.Atoi(getEnv("ACCESS_LOG_MAX_FILES", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_MAX_FILES: %v", err)
+	}
+	f, err := openRotatingFile(path, int64(maxMB)*1024*1024, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	l := &accessLogger{format: format, out: f, flush: f.Flush, close: f.Close}
+	go l.flushEvery(time.Second)
+	return l, nil
+}
+
+func (l *accessLogger) flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.flush()
+	}
+}
+
+func (l *accessLogger) Close() error {
+	return l.close()
+}
+
+type accessLogEntry struct {
+	Time         string  `json:"time"`
+	RemoteAddr   string  `json:"remote_addr"`
+	Method       string  `json:"method"`
+	URI          string  `json:"uri"`
+	Route        string  `json:"route"`
+	Protocol     string  `json:"protocol"`
+	Status       int     `json:"status"`
+	BodyBytes    int64   `json:"body_bytes"`
+	ResponseTime float64 `json:"response_time"`
+	DBTime       float64 `json:"db_time"`
+	RequestID    string  `json:"request_id"`
+	UserAgent    string  `json:"user_agent"`
+	Referer      string  `json:"referer"`
+}
+
+// ltsvValue LTSVの区切りになるタブと改行を空白にする
+func ltsvValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	if !strings.ContainsAny(s, "\t\r\n") {
+		return s
+	}
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+func (l *accessLogger) write(e *accessLogEntry) {
+	b := bytes.Buffer{}
+	if l.format == "json" {
+		json.NewEncoder(&b).Encode(e)
+	} else {
+		reqtime := strconv.FormatFloat(e.ResponseTime, 'f', 3, 64)
+		b.WriteString("time:" + e.Time +
+			"\thost:" + ltsvValue(e.RemoteAddr) +
+			"\tmethod:" + e.Method +
+			"\turi:" + ltsvValue(e.URI) +
+			"\troute:" + ltsvValue(e.Route) +
+			"\tprotocol:" + e.Protocol +
+			"\tstatus:" + strconv.Itoa(e.Status) +
+			"\tsize:" + strconv.FormatInt(e.BodyBytes, 10) +
+			"\treqtime:" + reqtime +
+			"\tapptime:" + reqtime +
+			"\tdbtime:" + strconv.FormatFloat(e.DBTime, 'f', 3, 64) +
+			"\treqid:" + ltsvValue(e.RequestID) +
+			"\tua:" + ltsvValue(e.UserAgent) +
+			"\treferer:" + ltsvValue(e.Referer) + "\n")
+	}
+	l.out.Write(b.Bytes())
+}
+
+// middleware 1リクエスト1行のアクセスログを書く。DB時間はリクエストのcontextを渡したクエリの分だけ数える
+func (l *accessLogger) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		req := c.Request()
+		ctx, timer := withDBTimer(req.Context())
+		c.SetRequest(req.WithContext(ctx))
+
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		res := c.Response()
+		l.write(&accessLogEntry{
+			Time:         start.Format(time.RFC3339),
+			RemoteAddr:   clientIP(req),
+			Method:       req.Method,
+			URI:          req.RequestURI,
+			Route:        routeTemplate(c),
+			Protocol:     req.Proto,
+			Status:       res.Status,
+			BodyBytes:    res.Size,
+			ResponseTime: time.Since(start).Seconds(),
+			DBTime:       time.Duration(atomic.LoadInt64(&timer.ns)).Seconds(),
+			RequestID:    res.Header().Get(echo.HeaderXRequestID),
+			UserAgent:    req.UserAgent(),
+			Referer:      req.Referer(),
+		})
+		return nil
+	}
+}
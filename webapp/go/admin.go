@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// adminToken 管理用エンドポイントに必要なトークン。ADMIN_TOKENで設定する
+var adminToken string
+
+// adminGuard トークンが設定されていればAuthorization: Bearerかトークン用のヘッダで照合する。
+// トークンがなければ、ADMIN_LISTENのローカルなリスナーから来たものだけ通す
+func adminGuard(local bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if adminToken == "" {
+				if local {
+					return next(c)
+				}
+				return &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "admin endpoints are disabled; set ADMIN_TOKEN or ADMIN_LISTEN"}
+			}
+			token := c.Request().Header.Get("X-Admin-Token")
+			if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				return &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "invalid admin token"}
+			}
+			return next(c)
+		}
+	}
+}
+
+// registerAdminRoutes /admin以下にpprof、トレース、メモリの統計を置く。
+// クエリなどの統計と、メールアドレスの入る購入記録・資料請求の参照は、決めたパスのままガードを付けて置く
+func registerAdminRoutes(e *echo.Echo, local bool) {
+	guard := adminGuard(local)
+	g := e.Group("/admin", guard)
+	g.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	// runtime/traceで取ったトレース。?seconds=で長さを指定する
+	g.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	g.GET("/debug/pprof/*", pprofIndex)
+	g.GET("/memstats", getMemStats)
+	g.POST("/gc", postGC)
+
+	e.GET("/debug/recommend_cache", getRecommendCacheStatus, guard)
+	e.GET("/debug/status", getDebugStatus, guard)
+	e.GET("/debug/queries", getQueryDigest, guard)
+	e.DELETE("/debug/queries", deleteQueryDigest, guard)
+	e.GET("/api/estate/req_doc/:id", getEstateDocumentRequests, guard)
+	e.GET("/api/orders", getOrders, guard)
+	e.GET("/api/orders/:id", getOrder, guard)
+}
+
+// pprofIndex pprof.Indexは/debug/pprof/からのパスでプロファイル名を決めるので付け替えて渡す
+func pprofIndex(c echo.Context) error {
+	r := c.Request()
+	r.URL.Path = "/debug/pprof/" + c.Param("*")
+	pprof.Index(c.Response(), r)
+	return nil
+}
+
+// adminServer ADMIN_LISTENで立てた管理用のサーバー。終了時に止める
+var adminServer *echo.Echo
+
+// startAdminServer 管理用エンドポイントだけを受ける別のリスナーを立てる。トークンなしで使うならループバックに限る。
+// SIGHUPで起動されたときは親から引き継いだls.adminを使い、なければ作ってls.adminに入れる
+func startAdminServer(addr string, ls *listenerSet, errorHandler echo.HTTPErrorHandler) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid ADMIN_LISTEN: %v", err)
+	}
+	if adminToken == "" {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("ADMIN_LISTEN must be a loopback address unless ADMIN_TOKEN is set: %s", addr)
+		}
+	}
+	if ls.admin == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		ls.admin = l
+	}
+
+	admin := echo.New()
+	admin.HideBanner = true
+	admin.HidePort = true
+	admin.HTTPErrorHandler = errorHandler
+	registerAdminRoutes(admin, true)
+	admin.Listener = ls.admin
+	adminServer = admin
+	go func() {
+		if err := admin.Start(""); err != nil && err != http.ErrServerClosed {
+			admin.Logger.Error(err)
+		}
+	}()
+	return nil
+}
+
+// PoolCounts countedPoolの取り出し回数
+type PoolCounts struct {
+	Name   string `json:"name"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// MemStatsResponse GCとヒープの要約。sync.Poolの効果を見るためにプールの取り出し回数も返す
+type MemStatsResponse struct {
+	GOGC           string       `json:"gogc"`
+	Goroutines     int          `json:"goroutines"`
+	HeapAlloc      uint64       `json:"heapAlloc"`
+	HeapInuse      uint64       `json:"heapInuse"`
+	HeapIdle       uint64       `json:"heapIdle"`
+	HeapReleased   uint64       `json:"heapReleased"`
+	HeapObjects    uint64       `json:"heapObjects"`
+	HeapSys        uint64       `json:"heapSys"`
+	Sys            uint64       `json:"sys"`
+	TotalAlloc     uint64       `json:"totalAlloc"`
+	Mallocs        uint64       `json:"mallocs"`
+	Frees          uint64       `json:"frees"`
+	NextGC         uint64       `json:"nextGC"`
+	NumGC          uint32       `json:"numGC"`
+	NumForcedGC    uint32       `json:"numForcedGC"`
+	GCCPUFraction  float64      `json:"gcCPUFraction"`
+	PauseTotalMs   float64      `json:"pauseTotalMs"`
+	RecentPausesMs []float64    `json:"recentPausesMs"`
+	LastGC         time.Time    `json:"lastGC"`
+	Pools          []PoolCounts `json:"pools"`
+}
+
+func newMemStatsResponse() MemStatsResponse {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	res := MemStatsResponse{
+		GOGC:           getEnv("GOGC", "100"),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      m.HeapAlloc,
+		HeapInuse:      m.HeapInuse,
+		HeapIdle:       m.HeapIdle,
+		HeapReleased:   m.HeapReleased,
+		HeapObjects:    m.HeapObjects,
+		HeapSys:        m.HeapSys,
+		Sys:            m.Sys,
+		TotalAlloc:     m.TotalAlloc,
+		Mallocs:        m.Mallocs,
+		Frees:          m.Frees,
+		NextGC:         m.NextGC,
+		NumGC:          m.NumGC,
+		NumForcedGC:    m.NumForcedGC,
+		GCCPUFraction:  m.GCCPUFraction,
+		PauseTotalMs:   float64(m.PauseTotalNs) / 1e6,
+		RecentPausesMs: []float64{},
+		Pools:          make([]PoolCounts, 0, len(countedPools)),
+	}
+	if m.LastGC > 0 {
+		res.LastGC = time.Unix(0, int64(m.LastGC))
+	}
+	// PauseNsは直近256回分のリングバッファ
+	for i := uint32(0); i < m.NumGC && i < 10; i++ {
+		res.RecentPausesMs = append(res.RecentPausesMs, float64(m.PauseNs[(m.NumGC-1-i)%256])/1e6)
+	}
+	for _, p := range countedPools {
+		res.Pools = append(res.Pools, PoolCounts{Name: p.Name, Hits: atomic.LoadUint64(&p.hits), Misses: atomic.LoadUint64(&p.misses)})
+	}
+	return res
+}
+
+func getMemStats(c echo.Context) error {
+	return JSON(c, http.StatusOK, newMemStatsResponse())
+}
+
+// postGC GCを走らせてから統計を返す。プールを外したときに残るヒープの量を比べるのに使う
+func postGC(c echo.Context) error {
+	runtime.GC()
+	if c.QueryParam("free") == "1" {
+		debug.FreeOSMemory()
+	}
+	return JSON(c, http.StatusOK, newMemStatsResponse())
+}
@@ -0,0 +1,71 @@
+package main
+
+import "math/bits"
+
+// bitset 検索インデックスの各条件に当てはまる位置の集合
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) has(i int) bool {
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+// and bとoの積集合をbに書き込む。oがnilなら空集合として扱う
+func (b bitset) and(o bitset) {
+	for i := range b {
+		if i < len(o) {
+			b[i] &= o[i]
+		} else {
+			b[i] = 0
+		}
+	}
+}
+
+func (b bitset) count() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// each 立っているビットを昇順に、fがfalseを返すまで辿る
+func (b bitset) each(f func(i int) bool) {
+	for wi, w := range b {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if !f(wi*64 + t) {
+				return
+			}
+			w &= w - 1
+		}
+	}
+}
+
+// page offset個飛ばしてからlimit個の位置をdstに追加する
+func (b bitset) page(dst []int, offset, limit int) []int {
+	b.each(func(i int) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		if limit == 0 {
+			return false
+		}
+		dst = append(dst, i)
+		limit--
+		return true
+	})
+	return dst
+}
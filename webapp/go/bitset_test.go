@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBitset(t *testing.T) {
+	b := newBitset(200)
+	for _, i := range []int{0, 3, 63, 64, 130, 199} {
+		b.set(i)
+	}
+	b.clear(3)
+	if b.has(3) || !b.has(64) {
+		t.Errorf("has(3) = %v, has(64) = %v", b.has(3), b.has(64))
+	}
+	if got := b.count(); got != 5 {
+		t.Errorf("count() = %d, want 5", got)
+	}
+
+	tests := []struct {
+		offset, limit int
+		want          []int
+	}{
+		{0, 2, []int{0, 63}},
+		{1, 3, []int{63, 64, 130}},
+		{4, 10, []int{199}},
+		{5, 10, nil},
+		{0, 0, nil},
+	}
+	for _, tt := range tests {
+		if got := b.page(nil, tt.offset, tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("page(%d, %d) = %v, want %v", tt.offset, tt.limit, got, tt.want)
+		}
+	}
+
+	o := newBitset(200)
+	o.set(64)
+	o.set(199)
+	b.and(o)
+	if got := b.page(nil, 0, 10); !reflect.DeepEqual(got, []int{64, 199}) {
+		t.Errorf("and: %v, want [64 199]", got)
+	}
+	// 一度も現れない条件のビットセットはnilなので、空集合として扱う
+	b.and(nil)
+	if got := b.count(); got != 0 {
+		t.Errorf("and(nil): count() = %d, want 0", got)
+	}
+}
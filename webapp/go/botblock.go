@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	botActionUnavailable = "503"
+	botActionTooMany     = "429"
+	botActionAllow       = "allow"
+)
+
+// BotRule User-Agentにマッチしたときの扱い。先に書いたルールが優先される
+type BotRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+
+	re *regexp.Regexp
+}
+
+// BotRules ルールファイルの中身。DryRunならマッチしてもログに出すだけで通す
+type BotRules struct {
+	DryRun bool      `json:"dryRun"`
+	Rules  []BotRule `json:"rules"`
+}
+
+// match User-Agentに最初にマッチしたルールを返す
+func (rs *BotRules) match(ua string) *BotRule {
+	for i := range rs.Rules {
+		if rs.Rules[i].re.MatchString(ua) {
+			return &rs.Rules[i]
+		}
+	}
+	return nil
+}
+
+func parseBotRules(b []byte) (*BotRules, error) {
+	rs := &BotRules{}
+	if err := json.Unmarshal(b, rs); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("rule %d: name is empty or duplicated: %q", i, r.Name)
+		}
+		names[r.Name] = true
+		switch r.Action {
+		case botActionUnavailable, botActionTooMany, botActionAllow:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", r.Name, r.Action)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		r.re = re
+	}
+	return rs, nil
+}
+
+// botRuleMatches ルールごとのマッチ数
+var botRuleMatches = newCounterVec()
+
+// botBlocker ルールファイルを監視して、変更があれば読み直す
+type botBlocker struct {
+	path    string
+	rules   atomic.Value // *BotRules
+	modTime time.Time
+	size    int64
+}
+
+// NewBotBlockerFromEnv BOT_RULES_PATHのルールファイルを読む。offならブロックしない
+func NewBotBlockerFromEnv() (*botBlocker, error) {
+	path := getEnv("BOT_RULES_PATH", "../fixture/bot_rules.json")
+	if path == "off" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(getEnv("BOT_RULES_RELOAD_INTERVAL", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BOT_RULES_RELOAD_INTERVAL: %v", err)
+	}
+	b := &botBlocker{path: path}
+	if _, err := b.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go b.watch(interval)
+	}
+	return b, nil
+}
+
+// reload ファイルが変わっていれば読み直す。壊れたファイルなら今のルールのまま使い続ける
+func (b *botBlocker) reload() (bool, error) {
+	st, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	if st.ModTime().Equal(b.modTime) && st.Size() == b.size {
+		return false, nil
+	}
+	content, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return false, err
+	}
+	rs, err := parseBotRules(content)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", b.path, err)
+	}
+	b.rules.Store(rs)
+	b.modTime, b.size = st.ModTime(), st.Size()
+	return true, nil
+}
+
+func (b *botBlocker) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if ok, err := b.reload(); err != nil {
+			log.Printf("bot rules: %v", err)
+		} else if ok {
+			rs := b.current()
+			log.Printf("bot rules: reloaded %s (%d rules, dryRun=%v)", b.path, len(rs.Rules), rs.DryRun)
+		}
+	}
+}
+
+func (b *botBlocker) current() *BotRules {
+	return b.rules.Load().(*BotRules)
+}
+
+// botBlockExempt ヘルスチェックと監視のパス。/initializeはnginxでしていたときと同じくブロックする
+var botBlockExempt = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/debug/status": true,
+	"/metrics":      true,
+}
+
+// middleware nginxでしていたUser-Agentによるブロック。運用のためのエンドポイントは対象にしない
+func (b *botBlocker) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if botBlockExempt[c.Path()] || strings.HasPrefix(c.Path(), "/admin/") {
+			return next(c)
+		}
+		rs := b.current()
+		r := rs.match(c.Request().UserAgent())
+		if r == nil {
+			return next(c)
+		}
+		if r.Action == botActionAllow {
+			botRuleMatches.inc(labels("rule", r.Name, "action", r.Action, "dry_run", "false"))
+			return next(c)
+		}
+		if rs.DryRun {
+			botRuleMatches.inc(labels("rule", r.Name, "action", r.Action, "dry_run", "true"))
+			log.Printf("bot rules: dry run: rule=%s action=%s path=%s ua=%q", r.Name, r.Action, c.Request().URL.Path, c.Request().UserAgent())
+			return next(c)
+		}
+		botRuleMatches.inc(labels("rule", r.Name, "action", r.Action, "dry_run", "false"))
+		if r.Action == botActionTooMany {
+			c.Response().Header().Set("Retry-After", "60")
+			return &APIError{Status: http.StatusTooManyRequests, Code: "too_many_requests", Message: r.Reason}
+		}
+		return &APIError{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: r.Reason}
+	}
+}
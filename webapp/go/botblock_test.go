@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func loadFixtureBotRules(t *testing.T) *BotRules {
+	t.Helper()
+	b, err := ioutil.ReadFile("../fixture/bot_rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := parseBotRules(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestParseBotRulesRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  string
+	}{
+		{"bad action", `{"rules":[{"name":"a","pattern":"x","action":"404"}]}`, "unknown action"},
+		{"bad regex", `{"rules":[{"name":"a","pattern":"(x","action":"503"}]}`, "missing closing"},
+		{"duplicate name", `{"rules":[{"name":"a","pattern":"x","action":"503"},{"name":"a","pattern":"y","action":"429"}]}`, "duplicated"},
+		{"empty name", `{"rules":[{"pattern":"x","action":"503"}]}`, "empty"},
+		{"broken json", `{"rules":[`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseBotRules([]byte(tt.rules))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseBotRules() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotRulesMatch(t *testing.T) {
+	rs := loadFixtureBotRules(t)
+	tests := []struct {
+		ua   string
+		rule string
+	}{
+		{"ISUCONbot/1.0", "isuconbot"},
+		{"ISUCONbot-Mobile/1.0", "isuconbot"},
+		{"ISUCONbot-Image/1.0", "isuconbot"},
+		{"Mediapartners-ISUCON", "mediapartners_isucon"},
+		{"ISUCONCoffee", "isucon_coffee"},
+		{"ISUCONFeedSeeker/1.0", "isucon_feed_seeker"},
+		{"ISUCONFeedSeekerBeta/1.0", "isucon_feed_seeker"},
+		{"crawler (https://isucon.invalid/support/faq/)", "isucon_crawler"},
+		{"crawler (https://isucon.invalid/help/jp/)", "isucon_crawler"},
+		{"isubot", "isubot"},
+		{"Isupider", "isupider"},
+		{"Isupider+", "isupider"},
+		{"Isupider-image+", "isupider"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "generic_bot"},
+		{"Mozilla/5.0 (compatible; YandexSpider; +http://yandex.com/bots)", "generic_bot"},
+		{"SomeCrawler", "generic_bot"},
+
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/85.0.4183.83 Safari/537.36", ""},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:80.0) Gecko/20100101 Firefox/80.0", ""},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 13_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Mobile/15E148 Safari/604.1", ""},
+		{"isucandar", ""},
+		{"robotics-lab-client/1.0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if r := rs.match(tt.ua); r != nil {
+			got = r.Name
+		}
+		if got != tt.rule {
+			t.Errorf("match(%q) = %q, want %q", tt.ua, got, tt.rule)
+		}
+	}
+}
+
+func serveWithBotRules(rs *BotRules, ua string) int {
+	return serveWithBotRulesAt(rs, http.MethodGet, "/api/estate/search", ua)
+}
+
+func serveWithBotRulesAt(rs *BotRules, method, path, ua string) int {
+	b := &botBlocker{}
+	b.rules.Store(rs)
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(b.middleware)
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	e.GET("/api/estate/search", ok)
+	e.POST("/initialize", ok)
+	e.GET("/healthz", ok)
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("User-Agent", ua)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestBotBlockerMiddleware(t *testing.T) {
+	rs := loadFixtureBotRules(t)
+	if code := serveWithBotRules(rs, "ISUCONbot/1.0"); code != http.StatusServiceUnavailable {
+		t.Errorf("ISUCONbot: status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := serveWithBotRules(rs, "Mozilla/5.0"); code != http.StatusOK {
+		t.Errorf("browser: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serveWithBotRulesAt(rs, http.MethodPost, "/initialize", "ISUCONbot/1.0"); code != http.StatusServiceUnavailable {
+		t.Errorf("/initialize: status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := serveWithBotRulesAt(rs, http.MethodGet, "/healthz", "ISUCONbot/1.0"); code != http.StatusOK {
+		t.Errorf("/healthz: status = %d, want %d", code, http.StatusOK)
+	}
+
+	dry := *rs
+	dry.DryRun = true
+	if code := serveWithBotRules(&dry, "ISUCONbot/1.0"); code != http.StatusOK {
+		t.Errorf("dry run: status = %d, want %d", code, http.StatusOK)
+	}
+
+	// 先に書いたallowが後ろのブロックより優先される
+	allow, err := parseBotRules([]byte(`{"rules":[
+		{"name":"friendly","pattern":"FriendlyBot","action":"allow"},
+		{"name":"slow","pattern":"SlowBot","action":"429"},
+		{"name":"generic","pattern":"(?i)bot","action":"503"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serveWithBotRules(allow, "FriendlyBot/1.0"); code != http.StatusOK {
+		t.Errorf("allow: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serveWithBotRules(allow, "SlowBot/1.0"); code != http.StatusTooManyRequests {
+		t.Errorf("429: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := serveWithBotRules(allow, "OtherBot/1.0"); code != http.StatusServiceUnavailable {
+		t.Errorf("block: status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
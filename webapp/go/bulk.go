@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// MySQLのプレースホルダ数の上限
+	bulkInsertMaxPlaceholders = 65535
+	// max_allowed_packet(5.7のデフォルトは4MiB)に余裕を持たせる
+	bulkInsertMaxBytes = 1024 * 1024
+)
+
+// bulkInserter プレースホルダ付きのmulti-row INSERTをチャンクに分けて実行する
+type bulkInserter struct {
+	table   string
+	columns []string
+}
+
+func (bi bulkInserter) rowPlaceholder() string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?,", len(bi.columns)), ",") + ")"
+}
+
+// Exec 全チャンクをtx内で実行する。コミットは呼び出し側で行う
+func (bi bulkInserter) Exec(ctx context.Context, tx *sqlx.Tx, rows [][]interface{}) error {
+	head := "INSERT INTO " + bi.table + "(" + strings.Join(bi.columns, ",") + ") VALUES "
+	placeholder := bi.rowPlaceholder()
+	maxRows := bulkInsertMaxPlaceholders / len(bi.columns)
+
+	query := builderPool.Get().(*strings.Builder)
+	defer putBuilderPool(query)
+	params := paramsPool.Get().([]interface{})
+	defer func() { putParamsPool(params) }()
+
+	flush := func() error {
+		if len(params) == 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, query.String(), params...)
+		query.Reset()
+		params = params[:0]
+		return err
+	}
+
+	n, size := 0, 0
+	for _, row := range rows {
+		rowSize := estimateRowSize(row)
+		if n > 0 && (n >= maxRows || size+rowSize > bulkInsertMaxBytes) {
+			if err := flush(); err != nil {
+				return err
+			}
+			n, size = 0, 0
+		}
+		if n == 0 {
+			query.WriteString(head)
+		} else {
+			query.WriteByte(',')
+		}
+		query.WriteString(placeholder)
+		params = append(params, row...)
+		n++
+		size += rowSize
+	}
+	return flush()
+}
+
+func estimateRowSize(row []interface{}) int {
+	size := 0
+	for _, v := range row {
+		if s, ok := v.(string); ok {
+			size += len(s) + 2
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
+
+var chairInserter = bulkInserter{
+	table:   "chair",
+	columns: []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock"},
+}
+
+var estateInserter = bulkInserter{
+	table:   "estate",
+	columns: []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity"},
+}
+
+// insertChairs chairsを1トランザクションで登録する
+func insertChairs(ctx context.Context, chairs []Chair) error {
+	rows := make([][]interface{}, len(chairs))
+	for i, c := range chairs {
+		rows[i] = []interface{}{c.ID, c.Name, c.Description, c.Thumbnail, c.Price, c.Height, c.Width, c.Depth, c.Color, c.Features, c.Kind, c.Popularity, c.Stock}
+	}
+	start := time.Now()
+	defer observeQuery("insert_chairs", start)
+	tx, err := chairDb.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := chairInserter.Exec(ctx, tx, rows); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertEstates estatesを1トランザクションで登録する
+func insertEstates(ctx context.Context, estates []Estate) error {
+	rows := make([][]interface{}, len(estates))
+	for i, e := range estates {
+		rows[i] = []interface{}{e.ID, e.Name, e.Description, e.Thumbnail, e.Address, e.Latitude, e.Longitude, e.Rent, e.DoorHeight, e.DoorWidth, e.Features, e.Popularity}
+	}
+	start := time.Now()
+	defer observeQuery("insert_estates", start)
+	tx, err := estateDb.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := estateInserter.Exec(ctx, tx, rows); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// paramError 検索パラメータの検証エラー
+type paramError struct {
+	Field  string
+	Reason string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("invalid parameter %s: %s", e.Field, e.Reason)
+}
+
+func (rc RangeCondition) lookup(field, s string) (*Range, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, &paramError{Field: field, Reason: "not an integer"}
+	}
+	for _, r := range rc.Ranges {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return nil, &paramError{Field: field, Reason: "unknown range id"}
+}
+
+func (lc ListCondition) contains(s string) bool {
+	for _, v := range lc.List {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (lc ListCondition) validate(field, s string) error {
+	if !lc.contains(s) {
+		return &paramError{Field: field, Reason: "unknown value"}
+	}
+	return nil
+}
+
+func (lc ListCondition) split(field, s string) ([]string, error) {
+	features := strings.Split(s, ",")
+	for _, f := range features {
+		if err := lc.validate(field, f); err != nil {
+			return nil, err
+		}
+	}
+	return features, nil
+}
+
+// maxEmailLength ordersとdocument_requestsのemail列の長さ
+const maxEmailLength = 256
+
+// validateEmail 空でなく、列に収まり、表示名の付かない1つのアドレスであること
+func validateEmail(field, s string) error {
+	if s == "" {
+		return &paramError{Field: field, Reason: "required"}
+	}
+	if len(s) > maxEmailLength {
+		return &paramError{Field: field, Reason: "too long"}
+	}
+	if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+		return &paramError{Field: field, Reason: "not an email address"}
+	}
+	return nil
+}
+
+// pagination page/perPageの検証済みの値
+type pagination struct {
+	Page    int
+	PerPage int
+}
+
+func parsePagination(c echo.Context) (pagination, error) {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 0 {
+		return pagination{}, &paramError{Field: "page", Reason: "must be a non-negative integer"}
+	}
+	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	if err != nil || perPage <= 0 {
+		return pagination{}, &paramError{Field: "perPage", Reason: "must be a positive integer"}
+	}
+	return pagination{Page: page, PerPage: perPage}, nil
+}
+
+func (p pagination) Offset() int {
+	return p.Page * p.PerPage
+}
+
+// chairSearchParams /api/chair/searchの検証済みの検索条件
+type chairSearchParams struct {
+	Price    *Range
+	Height   *Range
+	Width    *Range
+	Depth    *Range
+	Kind     string
+	Color    string
+	Features []string
+	pagination
+}
+
+func parseChairSearchParams(c echo.Context) (chairSearchParams, error) {
+	var p chairSearchParams
+	var err error
+	if s := c.QueryParam("priceRangeId"); s != "" {
+		if p.Price, err = chairSearchCondition.Price.lookup("priceRangeId", s); err != nil {
+			return p, err
+		}
+	}
+	if s := c.QueryParam("heightRangeId"); s != "" {
+		if p.Height, err = chairSearchCondition.Height.lookup("heightRangeId", s); err != nil {
+			return p, err
+		}
+	}
+	if s := c.QueryParam("widthRangeId"); s != "" {
+		if p.Width, err = chairSearchCondition.Width.lookup("widthRangeId", s); err != nil {
+			return p, err
+		}
+	}
+	if s := c.QueryParam("depthRangeId"); s != "" {
+		if p.Depth, err = chairSearchCondition.Depth.lookup("depthRangeId", s); err != nil {
+			return p, err
+		}
+	}
+	if s := c.QueryParam("kind"); s != "" {
+		if err = chairSearchCondition.Kind.validate("kind", s); err != nil {
+			return p, err
+		}
+		p.Kind = s
+	}
+	if s := c.QueryParam("color"); s != "" {
+		if err = chairSearchCondition.Color.validate("color", s); err != nil {
+			return p, err
+		}
+		p.Color = s
+	}
+	if s := c.QueryParam("features"); s != "" {
+		if p.Features, err = chairSearchCondition.Feature.split("features", s); err != nil {
+			return p, err
+		}
+	}
+	if p.Price == nil && p.Height == nil && p.Width == nil && p.Depth == nil &&
+		p.Kind == "" && p.Color == "" && len(p.Features) == 0 {
+		return p, &paramError{Field: "query", Reason: "no search condition"}
+	}
+	p.pagination, err = parsePagination(c)
+	return p, err
+}
+
+// estateFilter 物件の絞り込み条件
+type estateFilter struct {
+	DoorHeight *Range
+	DoorWidth  *Range
+	Rent       *Range
+	Features   []string
+}
+
+func (f *estateFilter) empty() bool {
+	return f.DoorHeight == nil && f.DoorWidth == nil && f.Rent == nil && len(f.Features) == 0
+}
+
+func parseEstateFilter(c echo.Context) (estateFilter, error) {
+	var f estateFilter
+	var err error
+	if s := c.QueryParam("doorHeightRangeId"); s != "" {
+		if f.DoorHeight, err = estateSearchCondition.DoorHeight.lookup("doorHeightRangeId", s); err != nil {
+			return f, err
+		}
+	}
+	if s := c.QueryParam("doorWidthRangeId"); s != "" {
+		if f.DoorWidth, err = estateSearchCondition.DoorWidth.lookup("doorWidthRangeId", s); err != nil {
+			return f, err
+		}
+	}
+	if s := c.QueryParam("rentRangeId"); s != "" {
+		if f.Rent, err = estateSearchCondition.Rent.lookup("rentRangeId", s); err != nil {
+			return f, err
+		}
+	}
+	if s := c.QueryParam("features"); s != "" {
+		if f.Features, err = estateSearchCondition.Feature.split("features", s); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// estateSearchParams /api/estate/searchの検証済みの検索条件
+type estateSearchParams struct {
+	estateFilter
+	pagination
+}
+
+func parseEstateSearchParams(c echo.Context) (estateSearchParams, error) {
+	var p estateSearchParams
+	var err error
+	if p.estateFilter, err = parseEstateFilter(c); err != nil {
+		return p, err
+	}
+	if p.empty() {
+		return p, &paramError{Field: "query", Reason: "no search condition"}
+	}
+	p.pagination, err = parsePagination(c)
+	return p, err
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	documentRequestPending = "pending"
+	documentRequestSent    = "sent"
+	documentRequestFailed  = "failed"
+
+	documentRequestMaxAttempts = 8
+	documentRequestBatchSize   = 100
+)
+
+// DocumentRequest 物件の資料請求
+type DocumentRequest struct {
+	ID            int64        `db:"id" json:"id"`
+	EstateID      int64        `db:"estate_id" json:"estateId"`
+	Email         string       `db:"email" json:"email"`
+	Status        string       `db:"status" json:"status"`
+	Attempts      int          `db:"attempts" json:"attempts"`
+	LastError     string       `db:"last_error" json:"lastError,omitempty"`
+	NextAttemptAt time.Time    `db:"next_attempt_at" json:"-"`
+	CreatedAt     time.Time    `db:"created_at" json:"createdAt"`
+	SentAt        sql.NullTime `db:"sent_at" json:"-"`
+}
+
+type DocumentRequestListResponse struct {
+	DocumentRequests []DocumentRequest `json:"documentRequests"`
+}
+
+var mailer Mailer
+
+// documentRequestRecipient 資料請求を受け取る担当者のアドレス
+var documentRequestRecipient string
+
+var documentRequestNotify = make(chan struct{}, 1)
+
+func notifyDocumentRequestWorker() {
+	select {
+	case documentRequestNotify <- struct{}{}:
+	default:
+	}
+}
+
+func createDocumentRequest(ctx context.Context, estateID int64, email string) error {
+	now := time.Now().UTC()
+	_, err := estateDb.ExecContext(ctx,
+		`INSERT INTO document_requests(estate_id,email,status,attempts,last_error,next_attempt_at,created_at) VALUES (?,?,?,0,'',?,?)`,
+		estateID, email, documentRequestPending, now, now,
+	)
+	observeQuery("document_request_insert", now)
+	if err != nil {
+		return err
+	}
+	notifyDocumentRequestWorker()
+	return nil
+}
+
+// getEstateDocumentRequests 請求者のメールアドレスが入るので、adminGuardを通ったものだけに返す
+func getEstateDocumentRequests(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return errInvalidID("id")
+	}
+	if _, ok := estateMap.Load(int64(id)); !ok {
+		return errNotFound("estate")
+	}
+
+	requests := []DocumentRequest{}
+	query := `SELECT id,estate_id,email,status,attempts,last_error,next_attempt_at,created_at,sent_at FROM document_requests WHERE estate_id=? ORDER BY created_at DESC, id DESC`
+	start := time.Now()
+	err = estateDb.SelectContext(c.Request().Context(), &requests, query, id)
+	observeQuery("document_requests_by_estate", start)
+	if err != nil {
+		return errInternal(err)
+	}
+	return JSON(c, http.StatusOK, DocumentRequestListResponse{DocumentRequests: requests})
+}
+
+// documentRequestBackoff 1秒から倍々で、最大1時間まで待つ
+func documentRequestBackoff(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if d <= 0 || d > time.Hour {
+		return time.Hour
+	}
+	return d
+}
+
+// documentRequestStop 閉じるとワーカーが今の送信を終えてから止まる
+var documentRequestStop = make(chan struct{})
+
+// runDocumentRequestWorker 配送待ちの資料請求をメールで送る
+func runDocumentRequestWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := deliverDocumentRequests(); err != nil {
+			log.Printf("document request worker: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-documentRequestNotify:
+		case <-documentRequestStop:
+			return
+		}
+	}
+}
+
+func deliverDocumentRequests() error {
+	for {
+		var requests []DocumentRequest
+		query := `SELECT id,estate_id,email,status,attempts,last_error,next_attempt_at,created_at,sent_at FROM document_requests WHERE status=? AND next_attempt_at<=? ORDER BY next_attempt_at LIMIT ?`
+		if err := estateDb.Select(&requests, query, documentRequestPending, time.Now().UTC(), documentRequestBatchSize); err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if err := deliverDocumentRequest(r); err != nil {
+				return err
+			}
+		}
+		if len(requests) < documentRequestBatchSize {
+			return nil
+		}
+		select {
+		case <-documentRequestStop:
+			return nil
+		default:
+		}
+	}
+}
+
+func deliverDocumentRequest(r DocumentRequest) error {
+	// 他のワーカーと取り合わないように次の試行時刻をずらして確保する
+	lease := time.Now().UTC().Add(time.Minute)
+	res, err := estateDb.Exec(`UPDATE document_requests SET next_attempt_at=? WHERE id=? AND status=? AND next_attempt_at=?`, lease, r.ID, documentRequestPending, r.NextAttemptAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	sendErr := mailer.Send(documentRequestMail(r))
+	now := time.Now().UTC()
+	if sendErr == nil {
+		_, err = estateDb.Exec(`UPDATE document_requests SET status=?,attempts=attempts+1,last_error='',sent_at=? WHERE id=?`, documentRequestSent, now, r.ID)
+		return err
+	}
+
+	attempts := r.Attempts + 1
+	status := documentRequestPending
+	if attempts >= documentRequestMaxAttempts {
+		status = documentRequestFailed
+	}
+	msg := sendErr.Error()
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	_, err = estateDb.Exec(`UPDATE document_requests SET status=?,attempts=?,last_error=?,next_attempt_at=? WHERE id=?`, status, attempts, msg, now.Add(documentRequestBackoff(attempts)), r.ID)
+	return err
+}
+
+func documentRequestMail(r DocumentRequest) Mail {
+	var estate Estate
+	if val, ok := estateMap.Load(r.EstateID); ok {
+		estate = val.(Estate)
+	}
+	return Mail{
+		To:      documentRequestRecipient,
+		ReplyTo: r.Email,
+		Subject: fmt.Sprintf("[isuumo] 資料請求 #%d: %s", r.ID, estate.Name),
+		Body: fmt.Sprintf("以下の物件に資料請求がありました。\n\n物件ID: %d\n物件名: %s\n住所: %s\n請求者: %s\n受付日時: %s\n",
+			r.EstateID, estate.Name, estate.Address, r.Email, r.CreatedAt.Format(time.RFC3339)),
+	}
+}
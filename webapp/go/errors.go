@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// FieldError 不正なパラメータの詳細
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// APIError ハンドラが返すエラー。httpErrorHandlerでJSONにして返す
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"requestId,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+
+	// Internal ログにだけ出す原因
+	Internal error `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Internal != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Internal)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func errBadRequest(message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: message}
+}
+
+// errInvalidParam paramErrorをフィールドの詳細付きの400にする
+func errInvalidParam(err error) *APIError {
+	e := errBadRequest("invalid parameter")
+	if pe, ok := err.(*paramError); ok {
+		e.Fields = []FieldError{{Field: pe.Field, Reason: pe.Reason}}
+	}
+	return e
+}
+
+func errInvalidID(field string) *APIError {
+	return errInvalidParam(&paramError{Field: field, Reason: "not an integer"})
+}
+
+func errNotFound(resource string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: "not_found", Message: resource + " not found"}
+}
+
+func errConflict(message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: "conflict", Message: message}
+}
+
+func errUnprocessable(message string) *APIError {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "unprocessable_entity", Message: message}
+}
+
+func errUnavailable(message string) *APIError {
+	return &APIError{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: message}
+}
+
+func errInternal(err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: "internal_server_error", Message: "internal server error", Internal: err}
+}
+
+func toAPIError(err error) *APIError {
+	switch e := err.(type) {
+	case *APIError:
+		copied := *e
+		return &copied
+	case *echo.HTTPError:
+		apiErr := &APIError{Status: e.Code, Code: "http_error", Message: fmt.Sprint(e.Message), Internal: e.Internal}
+		switch e.Code {
+		case http.StatusBadRequest:
+			apiErr.Code = "bad_request"
+		case http.StatusNotFound:
+			apiErr.Code = "not_found"
+		case http.StatusMethodNotAllowed:
+			apiErr.Code = "method_not_allowed"
+		case http.StatusRequestEntityTooLarge:
+			apiErr.Code = "request_entity_too_large"
+		}
+		return apiErr
+	default:
+		return errInternal(err)
+	}
+}
+
+// httpErrorHandler 全ハンドラのエラーを同じ形のJSONで返す
+func httpErrorHandler(err error, c echo.Context) {
+	apiErr := toAPIError(err)
+	apiErr.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	if apiErr.Status >= http.StatusInternalServerError {
+		c.Logger().Errorf("request_id=%s %s %s: %v", apiErr.RequestID, c.Request().Method, c.Request().URL.Path, apiErr)
+	}
+	if c.Response().Committed {
+		return
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		// goccy/go-jsonはomitemptyなスライスを正しく出力できないのでencoding/jsonを使う
+		err = c.JSON(apiErr.Status, apiErr)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
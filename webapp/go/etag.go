@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo"
+)
+
+// cacheControlPolicies ルートのテンプレートごとのCache-Control。
+// 検索条件は固定のfixtureなので長く、物件は変わらないので短めにキャッシュさせる。
+// 椅子は売り切れると404になるので、毎回ETagで確かめさせる
+var cacheControlPolicies = map[string]string{
+	"/api/chair/search/condition":  "public, max-age=86400",
+	"/api/estate/search/condition": "public, max-age=86400",
+	"/api/estate/:id":              "public, max-age=300",
+	"/api/chair/:id":               "public, no-cache",
+}
+
+// contentETag 本文のハッシュから強いETagを作る
+func contentETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatches If-None-Matchのどれかがetagと一致するか。If-None-Matchは弱い比較なのでW/を外して比べる
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONWithETag ETagとルートのCache-Controlを付けてJSONを返す。クライアントが同じETagを持っていれば本文なしの304にする。
+// エラーはここを通らないのでキャッシュされない
+func writeJSONWithETag(c echo.Context, body []byte, etag string) error {
+	if policy, ok := cacheControlPolicies[c.Path()]; ok {
+		c.Response().Header().Set("Cache-Control", policy)
+	}
+	c.Response().Header().Set("ETag", etag)
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+	_, err := c.Response().Write(body)
+	return err
+}
+
+// ETagJSON JSONに直した本文からETagを計算して返す
+func ETagJSON(c echo.Context, i interface{}) error {
+	b := bytes.Buffer{}
+	if err := json.NewEncoder(&b).Encode(i); err != nil {
+		return err
+	}
+	return writeJSONWithETag(c, b.Bytes(), contentETag(b.Bytes()))
+}
+
+// staticJSON 起動後に変わらないレスポンス。本文とETagを一度だけ作っておく
+type staticJSON struct {
+	body []byte
+	etag string
+}
+
+func newStaticJSON(i interface{}) staticJSON {
+	b := bytes.Buffer{}
+	json.NewEncoder(&b).Encode(i)
+	return staticJSON{body: b.Bytes(), etag: contentETag(b.Bytes())}
+}
+
+func (s staticJSON) serve(c echo.Context) error {
+	return writeJSONWithETag(c, s.body, s.etag)
+}
+
+var chairSearchConditionJSON staticJSON
+var estateSearchConditionJSON staticJSON
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// nazotteGridSize グリッドの1マスの大きさ(度)
+const nazotteGridSize = 0.05
+
+type gridCell struct {
+	lat int64
+	lng int64
+}
+
+func cellOf(latitude, longitude float64) gridCell {
+	return gridCell{
+		lat: int64(math.Floor(latitude / nazotteGridSize)),
+		lng: int64(math.Floor(longitude / nazotteGridSize)),
+	}
+}
+
+// estateGrid 緯度経度のグリッドごとに物件の位置(estateIndex.estatesの添字)を持つ
+type estateGrid map[gridCell][]int
+
+func (g estateGrid) add(e Estate, i int) {
+	cell := cellOf(e.Latitude, e.Longitude)
+	g[cell] = append(g[cell], i)
+}
+
+// candidates バウンディングボックスに掛かるマスの物件の位置を昇順(=人気順)で返す
+func (g estateGrid) candidates(b BoundingBox) []int {
+	min := cellOf(b.TopLeftCorner.Latitude, b.TopLeftCorner.Longitude)
+	max := cellOf(b.BottomRightCorner.Latitude, b.BottomRightCorner.Longitude)
+	var positions []int
+	latSpan, lngSpan, cells := max.lat-min.lat+1, max.lng-min.lng+1, int64(len(g))
+	// 掛け算があふれないように、辺の長さを先に比べる
+	if latSpan > cells || lngSpan > cells || latSpan*lngSpan > cells {
+		// 範囲が広すぎるときはマスを全部なめた方が速い
+		for cell, ps := range g {
+			if cell.lat >= min.lat && cell.lat <= max.lat && cell.lng >= min.lng && cell.lng <= max.lng {
+				positions = append(positions, ps...)
+			}
+		}
+	} else {
+		for lat := min.lat; lat <= max.lat; lat++ {
+			for lng := min.lng; lng <= max.lng; lng++ {
+				positions = append(positions, g[gridCell{lat: lat, lng: lng}]...)
+			}
+		}
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+func (b BoundingBox) contains(latitude, longitude float64) bool {
+	return b.TopLeftCorner.Latitude <= latitude && latitude <= b.BottomRightCorner.Latitude &&
+		b.TopLeftCorner.Longitude <= longitude && longitude <= b.BottomRightCorner.Longitude
+}
+
+// onSegment pがaとbを結ぶ線分上にあるか
+func onSegment(p, a, b Coordinate) bool {
+	cross := (b.Latitude-a.Latitude)*(p.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(p.Latitude-a.Latitude)
+	if cross != 0 {
+		return false
+	}
+	return math.Min(a.Latitude, b.Latitude) <= p.Latitude && p.Latitude <= math.Max(a.Latitude, b.Latitude) &&
+		math.Min(a.Longitude, b.Longitude) <= p.Longitude && p.Longitude <= math.Max(a.Longitude, b.Longitude)
+}
+
+// onRing pがringの辺上にあるか
+func onRing(ring []Coordinate, p Coordinate) bool {
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		if onSegment(p, ring[i], ring[j]) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPoint MySQLのST_Containsと同じく、境界上の点は含まないものとして判定する
+func containsPoint(ring []Coordinate, p Coordinate) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if onSegment(p, a, b) {
+			return false
+		}
+		if (a.Longitude > p.Longitude) != (b.Longitude > p.Longitude) &&
+			p.Latitude < (b.Latitude-a.Latitude)*(p.Longitude-a.Longitude)/(b.Longitude-a.Longitude)+a.Latitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// nazotteShape なぞった領域
+type nazotteShape interface {
+	boundingBox() BoundingBox
+	contains(p Coordinate) bool
+}
+
+func (cs Coordinates) boundingBox() BoundingBox {
+	return cs.getBoundingBox()
+}
+
+func (cs Coordinates) contains(p Coordinate) bool {
+	return containsPoint(cs.Coordinates, p)
+}
+
+// nazotte shapeに含まれる物件を人気順にlimit件までdstに追加して返す
+func (ei *estateIndex) nazotte(shape nazotteShape, limit int, dst []Estate) []Estate {
+	b := shape.boundingBox()
+
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+	for _, i := range ei.grid.candidates(b) {
+		e := ei.estates[i]
+		if !b.contains(e.Latitude, e.Longitude) {
+			continue
+		}
+		if !shape.contains(Coordinate{Latitude: e.Latitude, Longitude: e.Longitude}) {
+			continue
+		}
+		dst = append(dst, e)
+		if len(dst) >= limit {
+			break
+		}
+	}
+	return dst
+}
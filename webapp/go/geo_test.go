@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func coord(lat, lng float64) Coordinate {
+	return Coordinate{Latitude: lat, Longitude: lng}
+}
+
+// MySQLのST_Containsは境界上の点を含まない。穴の境界も多角形の境界になる
+func TestPolygonContainsMatchesSTContains(t *testing.T) {
+	square := []Coordinate{coord(0, 0), coord(0, 10), coord(10, 10), coord(10, 0), coord(0, 0)}
+	hole := []Coordinate{coord(4, 4), coord(4, 6), coord(6, 6), coord(6, 4), coord(4, 4)}
+	// 凹んだ多角形。(5, 5)から右下へ切り込みがある
+	concave := []Coordinate{coord(0, 0), coord(0, 10), coord(10, 10), coord(5, 5), coord(10, 0), coord(0, 0)}
+	// 斜めの辺だけの三角形
+	triangle := []Coordinate{coord(0, 0), coord(4, 8), coord(8, 0)}
+
+	tests := []struct {
+		name  string
+		shape nazotteShape
+		p     Coordinate
+		want  bool
+	}{
+		{"inside", polygon{square}, coord(2, 3), true},
+		{"vertex", polygon{square}, coord(0, 0), false},
+		{"opposite vertex", polygon{square}, coord(10, 10), false},
+		{"on edge", polygon{square}, coord(0, 5), false},
+		{"on closing edge", polygon{square}, coord(5, 0), false},
+		{"just inside edge", polygon{square}, coord(1e-9, 5), true},
+		{"just outside edge", polygon{square}, coord(-1e-9, 5), false},
+		{"outside on edge line", polygon{square}, coord(0, 11), false},
+		{"far outside", polygon{square}, coord(20, 20), false},
+
+		{"inside hole", polygon{square, hole}, coord(5, 5), false},
+		{"hole vertex", polygon{square, hole}, coord(4, 4), false},
+		{"hole edge", polygon{square, hole}, coord(4, 5), false},
+		{"just outside hole", polygon{square, hole}, coord(4-1e-9, 5), true},
+		{"just inside hole", polygon{square, hole}, coord(4+1e-9, 5), false},
+		{"between hole and shell", polygon{square, hole}, coord(2, 8), true},
+
+		{"concave inside", polygon{concave}, coord(2, 5), true},
+		{"concave notch", polygon{concave}, coord(8, 5), false},
+		{"concave reflex vertex", polygon{concave}, coord(5, 5), false},
+		{"concave notch edge", polygon{concave}, coord(7.5, 7.5), false},
+		{"concave beside notch", polygon{concave}, coord(8, 9), true},
+
+		{"triangle inside", Coordinates{Coordinates: triangle}, coord(4, 4), true},
+		{"triangle apex", Coordinates{Coordinates: triangle}, coord(4, 8), false},
+		{"triangle slanted edge", Coordinates{Coordinates: triangle}, coord(2, 4), false},
+		{"triangle open closing edge", Coordinates{Coordinates: triangle}, coord(4, 0), false},
+		{"triangle outside slanted edge", Coordinates{Coordinates: triangle}, coord(1, 4), false},
+
+		{"multi first", multiPolygon{{square}, {[]Coordinate{coord(20, 20), coord(20, 30), coord(30, 30), coord(30, 20)}}}, coord(5, 5), true},
+		{"multi second", multiPolygon{{square}, {[]Coordinate{coord(20, 20), coord(20, 30), coord(30, 30), coord(30, 20)}}}, coord(25, 25), true},
+		{"multi between", multiPolygon{{square}, {[]Coordinate{coord(20, 20), coord(20, 30), coord(30, 30), coord(30, 20)}}}, coord(15, 15), false},
+	}
+	for _, tt := range tests {
+		if got := tt.shape.contains(tt.p); got != tt.want {
+			t.Errorf("%s: contains(%v) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestEstateIndexNazotte(t *testing.T) {
+	estates := []Estate{
+		{ID: 1, Latitude: 35.60, Longitude: 139.60, Popularity: 10}, // 頂点
+		{ID: 2, Latitude: 35.65, Longitude: 139.65, Popularity: 9},
+		{ID: 3, Latitude: 35.60, Longitude: 139.65, Popularity: 8}, // 辺
+		{ID: 4, Latitude: 35.69, Longitude: 139.61, Popularity: 7},
+		{ID: 5, Latitude: 35.75, Longitude: 139.65, Popularity: 6}, // 外
+		{ID: 6, Latitude: 35.61, Longitude: 139.69, Popularity: 5},
+		{ID: 7, Latitude: 35.62, Longitude: 139.62, Popularity: 5},
+	}
+	ei := &estateIndex{}
+	ei.load(append([]Estate{}, estates...))
+	shape := Coordinates{Coordinates: []Coordinate{
+		coord(35.60, 139.60), coord(35.60, 139.70), coord(35.70, 139.70), coord(35.70, 139.60), coord(35.60, 139.60),
+	}}
+
+	tests := []struct {
+		limit int
+		want  []int64
+	}{
+		{10, []int64{2, 4, 6, 7}},
+		// 人気順に並べてから件数を切る
+		{3, []int64{2, 4, 6}},
+	}
+	for _, tt := range tests {
+		got := ei.nazotte(shape, tt.limit, nil)
+		ids := make([]int64, 0, len(got))
+		for _, e := range got {
+			ids = append(ids, e.ID)
+		}
+		if len(ids) != len(tt.want) {
+			t.Errorf("nazotte(limit=%d) = %v, want %v", tt.limit, ids, tt.want)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.want[i] {
+				t.Errorf("nazotte(limit=%d) = %v, want %v", tt.limit, ids, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo"
+)
+
+const MIMEApplicationGeoJSON = "application/geo+json"
+
+var errInvalidGeoJSON = errors.New("invalid geojson")
+
+// polygon GeoJSONのPolygon。先頭が外周、残りが穴
+type polygon [][]Coordinate
+
+func (p polygon) boundingBox() BoundingBox {
+	return Coordinates{Coordinates: p[0]}.getBoundingBox()
+}
+
+// contains 穴の中と、外周・穴の境界上の点は含まない
+func (p polygon) contains(c Coordinate) bool {
+	if !containsPoint(p[0], c) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if onRing(hole, c) || containsPoint(hole, c) {
+			return false
+		}
+	}
+	return true
+}
+
+type multiPolygon []polygon
+
+func (mp multiPolygon) boundingBox() BoundingBox {
+	b := mp[0].boundingBox()
+	for _, p := range mp[1:] {
+		pb := p.boundingBox()
+		if pb.TopLeftCorner.Latitude < b.TopLeftCorner.Latitude {
+			b.TopLeftCorner.Latitude = pb.TopLeftCorner.Latitude
+		}
+		if pb.TopLeftCorner.Longitude < b.TopLeftCorner.Longitude {
+			b.TopLeftCorner.Longitude = pb.TopLeftCorner.Longitude
+		}
+		if pb.BottomRightCorner.Latitude > b.BottomRightCorner.Latitude {
+			b.BottomRightCorner.Latitude = pb.BottomRightCorner.Latitude
+		}
+		if pb.BottomRightCorner.Longitude > b.BottomRightCorner.Longitude {
+			b.BottomRightCorner.Longitude = pb.BottomRightCorner.Longitude
+		}
+	}
+	return b
+}
+
+func (mp multiPolygon) contains(c Coordinate) bool {
+	for _, p := range mp {
+		if p.contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// valid 緯度経度の範囲に入っているか。NaNもはじく
+func (c Coordinate) valid() bool {
+	return -90 <= c.Latitude && c.Latitude <= 90 && -180 <= c.Longitude && c.Longitude <= 180
+}
+
+// geoJSONPosition GeoJSONの座標は[経度, 緯度]の順
+type geoJSONPosition [2]float64
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// nazotteRequest 独自形式のCoordinatesと、GeoJSONのPolygon/MultiPolygon/Featureのどれか
+type nazotteRequest struct {
+	Type        string           `json:"type"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+	Geometry    *geoJSONGeometry `json:"geometry"`
+}
+
+func toRing(positions []geoJSONPosition) ([]Coordinate, error) {
+	if len(positions) < 3 {
+		return nil, errInvalidGeoJSON
+	}
+	ring := make([]Coordinate, len(positions))
+	for i, p := range positions {
+		ring[i] = Coordinate{Latitude: p[1], Longitude: p[0]}
+		if !ring[i].valid() {
+			return nil, errInvalidGeoJSON
+		}
+	}
+	return ring, nil
+}
+
+func toPolygon(rings [][]geoJSONPosition) (polygon, error) {
+	if len(rings) == 0 {
+		return nil, errInvalidGeoJSON
+	}
+	p := make(polygon, len(rings))
+	for i, r := range rings {
+		ring, err := toRing(r)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = ring
+	}
+	return p, nil
+}
+
+func parseGeoJSONGeometry(g geoJSONGeometry) (nazotteShape, error) {
+	switch g.Type {
+	case "Polygon":
+		var rings [][]geoJSONPosition
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return nil, errInvalidGeoJSON
+		}
+		return toPolygon(rings)
+	case "MultiPolygon":
+		var polygons [][][]geoJSONPosition
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil || len(polygons) == 0 {
+			return nil, errInvalidGeoJSON
+		}
+		mp := make(multiPolygon, len(polygons))
+		for i, rings := range polygons {
+			p, err := toPolygon(rings)
+			if err != nil {
+				return nil, err
+			}
+			mp[i] = p
+		}
+		return mp, nil
+	default:
+		return nil, errInvalidGeoJSON
+	}
+}
+
+func parseNazotteRequest(body []byte) (nazotteShape, error) {
+	var req nazotteRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, errInvalidGeoJSON
+	}
+	switch req.Type {
+	case "":
+		var cs []Coordinate
+		if err := json.Unmarshal(req.Coordinates, &cs); err != nil || len(cs) < 3 {
+			return nil, errInvalidGeoJSON
+		}
+		for _, c := range cs {
+			if !c.valid() {
+				return nil, errInvalidGeoJSON
+			}
+		}
+		return Coordinates{Coordinates: cs}, nil
+	case "Feature":
+		if req.Geometry == nil {
+			return nil, errInvalidGeoJSON
+		}
+		return parseGeoJSONGeometry(*req.Geometry)
+	default:
+		return parseGeoJSONGeometry(geoJSONGeometry{Type: req.Type, Coordinates: req.Coordinates})
+	}
+}
+
+type geoJSONPoint struct {
+	Type        string          `json:"type"`
+	Coordinates geoJSONPosition `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string       `json:"type"`
+	ID         int64        `json:"id"`
+	Geometry   geoJSONPoint `json:"geometry"`
+	Properties Estate       `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func newEstateFeatureCollection(estates []Estate) geoJSONFeatureCollection {
+	fc := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, len(estates))}
+	for i, e := range estates {
+		fc.Features[i] = geoJSONFeature{
+			Type:       "Feature",
+			ID:         e.ID,
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: geoJSONPosition{e.Longitude, e.Latitude}},
+			Properties: e,
+		}
+	}
+	return fc
+}
+
+// wantsGeoJSON ?format=geojsonかAcceptヘッダでGeoJSONが求められているか
+func wantsGeoJSON(c echo.Context) bool {
+	if c.QueryParam("format") == "geojson" {
+		return true
+	}
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), MIMEApplicationGeoJSON)
+}
+
+func GeoJSON(c echo.Context, code int, i interface{}) error {
+	c.Response().Header().Set(echo.HeaderContentType, MIMEApplicationGeoJSON)
+	c.Response().WriteHeader(code)
+	return json.NewEncoder(c.Response()).Encode(i)
+}
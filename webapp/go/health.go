@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const pingTimeout = time.Second
+
+var startedAt = time.Now()
+
+// readinessExempt 読み込み中でも応答するパス
+var readinessExempt = map[string]bool{
+	"/initialize":   true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/debug/status": true,
+	"/metrics":      true,
+}
+
+// CheckResult /readyzの各項目の結果
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// ReadyChecks goccy/go-jsonはmapを正しく出力できないので構造体にする
+type ReadyChecks struct {
+	EstateDB CheckResult `json:"estateDb"`
+	ChairDB  CheckResult `json:"chairDb"`
+	Maps     CheckResult `json:"maps"`
+	Fixtures CheckResult `json:"fixtures"`
+}
+
+type ReadyResponse struct {
+	Ready  bool        `json:"ready"`
+	Checks ReadyChecks `json:"checks"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+func getHealthz(c echo.Context) error {
+	return JSON(c, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+func pingDB(ctx context.Context, db *sql.DB) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return CheckResult{OK: false, Detail: err.Error()}
+	}
+	return CheckResult{OK: true, Detail: time.Since(start).String()}
+}
+
+func fixturesParsed() bool {
+	return len(chairSearchCondition.Price.Ranges) > 0 && len(estateSearchCondition.Rent.Ranges) > 0
+}
+
+// getReadyz DBに届かない、またはデータを読み込んでいないときは503を返してnginxに外してもらう
+func getReadyz(c echo.Context) error {
+	ctx := c.Request().Context()
+	var estatePing, chairPing CheckResult
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		estatePing = pingDB(ctx, estateDb.DB)
+	}()
+	go func() {
+		defer wg.Done()
+		chairPing = pingDB(ctx, chairDb.DB)
+	}()
+	wg.Wait()
+
+	checks := ReadyChecks{
+		EstateDB: estatePing,
+		ChairDB:  chairPing,
+		Maps:     CheckResult{OK: isReady(), Detail: "chairMap and estateMap loaded"},
+		Fixtures: CheckResult{OK: fixturesParsed(), Detail: "search conditions parsed"},
+	}
+	res := ReadyResponse{
+		Ready:  checks.EstateDB.OK && checks.ChairDB.OK && checks.Maps.OK && checks.Fixtures.OK,
+		Checks: checks,
+	}
+	if !res.Ready {
+		return JSON(c, http.StatusServiceUnavailable, res)
+	}
+	return JSON(c, http.StatusOK, res)
+}
+
+// PoolStats sql.DBStatsのうち見たいもの
+type PoolStats struct {
+	MaxOpenConnections int     `json:"maxOpenConnections"`
+	OpenConnections    int     `json:"openConnections"`
+	InUse              int     `json:"inUse"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"waitCount"`
+	WaitDurationMs     float64 `json:"waitDurationMs"`
+	MaxIdleClosed      int64   `json:"maxIdleClosed"`
+	MaxLifetimeClosed  int64   `json:"maxLifetimeClosed"`
+}
+
+func newPoolStats(s sql.DBStats) PoolStats {
+	return PoolStats{
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDurationMs:     float64(s.WaitDuration.Microseconds()) / 1000,
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+	}
+}
+
+type PoolStatsByDB struct {
+	EstateDB PoolStats `json:"estateDb"`
+	ChairDB  PoolStats `json:"chairDb"`
+}
+
+type MapSizes struct {
+	ChairMap  int `json:"chairMap"`
+	EstateMap int `json:"estateMap"`
+}
+
+type IndexSizes struct {
+	Chairs        int `json:"chairs"`
+	ChairsInStock int `json:"chairsInStock"`
+	Estates       int `json:"estates"`
+}
+
+type CacheSizes struct {
+	RecommendChair    int `json:"recommendChair"`
+	LowPriced         int `json:"lowPriced"`
+	ChairIdempotency  int `json:"chairIdempotency"`
+	EstateIdempotency int `json:"estateIdempotency"`
+}
+
+type StatusResponse struct {
+	Ready         bool                `json:"ready"`
+	UptimeSeconds float64             `json:"uptimeSeconds"`
+	Goroutines    int                 `json:"goroutines"`
+	Pools         PoolStatsByDB       `json:"pools"`
+	Maps          MapSizes            `json:"maps"`
+	Indexes       IndexSizes          `json:"indexes"`
+	Caches        CacheSizes          `json:"caches"`
+	Recommend     RecommendCacheStats `json:"recommendCache"`
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func getDebugStatus(c echo.Context) error {
+	chairSearchIndex.mu.RLock()
+	chairs, inStock := len(chairSearchIndex.chairs), chairSearchIndex.inStock.count()
+	chairSearchIndex.mu.RUnlock()
+	estateSearchIndex.mu.RLock()
+	estates := len(estateSearchIndex.estates)
+	estateSearchIndex.mu.RUnlock()
+
+	recommendChairCacheMux.RLock()
+	recommendChairEntries := len(recommendChairCache)
+	recommendChairCacheMux.RUnlock()
+	chairIdempotency.mu.Lock()
+	chairIdempotencyEntries := len(chairIdempotency.responses)
+	chairIdempotency.mu.Unlock()
+	estateIdempotency.mu.Lock()
+	estateIdempotencyEntries := len(estateIdempotency.responses)
+	estateIdempotency.mu.Unlock()
+
+	return JSON(c, http.StatusOK, StatusResponse{
+		Ready:         isReady(),
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+		Pools: PoolStatsByDB{
+			EstateDB: newPoolStats(estateDb.Stats()),
+			ChairDB:  newPoolStats(chairDb.Stats()),
+		},
+		Maps: MapSizes{
+			ChairMap:  syncMapLen(&chairMap),
+			EstateMap: syncMapLen(&estateMap),
+		},
+		Indexes: IndexSizes{
+			Chairs:        chairs,
+			ChairsInStock: inStock,
+			Estates:       estates,
+		},
+		Caches: CacheSizes{
+			RecommendChair:    recommendChairEntries,
+			LowPriced:         syncMapLen(&lowPriced),
+			ChairIdempotency:  chairIdempotencyEntries,
+			EstateIdempotency: estateIdempotencyEntries,
+		},
+		Recommend: getRecommendCacheStats(),
+	})
+}
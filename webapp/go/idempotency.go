@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const headerIdempotencyKey = "Idempotency-Key"
+
+// idempotencyWindow 同じキーのリクエストをリプレイする期間。IDEMPOTENCY_WINDOWで変更できる
+var idempotencyWindow = 24 * time.Hour
+
+// idempotencyStoreTimeout レスポンスをMySQLに保存するのにかける時間
+const idempotencyStoreTimeout = 5 * time.Second
+
+// idempotentResponse 最初のリクエストに返したレスポンス
+type idempotentResponse struct {
+	Key         string    `db:"idempotency_key"`
+	Fingerprint string    `db:"fingerprint"`
+	Status      int       `db:"status"`
+	ContentType string    `db:"content_type"`
+	Body        []byte    `db:"body"`
+	CreatedAt   time.Time `db:"created_at"`
+
+	pending bool
+}
+
+func (r *idempotentResponse) expired(now time.Time) bool {
+	return r.CreatedAt.Add(idempotencyWindow).Before(now)
+}
+
+// idempotencyStore レスポンスをメモリに保持し、MySQLにも書いておいて再起動後や他ホストからも参照できるようにする
+type idempotencyStore struct {
+	db func() *sqlx.DB
+
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+var chairIdempotency = &idempotencyStore{db: func() *sqlx.DB { return chairDb }}
+var estateIdempotency = &idempotencyStore{db: func() *sqlx.DB { return estateDb }}
+
+func resetIdempotency() {
+	chairIdempotency.reset()
+	estateIdempotency.reset()
+}
+
+func (s *idempotencyStore) reset() {
+	s.mu.Lock()
+	s.responses = make(map[string]*idempotentResponse)
+	s.mu.Unlock()
+}
+
+// begin 処理中の印を付ける。既にレスポンスがあるか処理中であればそれを返す
+func (s *idempotencyStore) begin(ctx context.Context, key, fingerprint string) (*idempotentResponse, error) {
+	now := time.Now()
+	s.mu.Lock()
+	if r, ok := s.responses[key]; ok && !r.expired(now) {
+		s.mu.Unlock()
+		return r, nil
+	}
+	pending := &idempotentResponse{Key: key, Fingerprint: fingerprint, CreatedAt: now, pending: true}
+	s.responses[key] = pending
+	s.mu.Unlock()
+
+	var r idempotentResponse
+	query := `SELECT idempotency_key,fingerprint,status,content_type,body,created_at FROM idempotency_keys WHERE idempotency_key=? AND created_at>=?`
+	start := time.Now()
+	err := s.db().GetContext(ctx, &r, query, key, now.Add(-idempotencyWindow).UTC())
+	observeQuery("idempotency_lookup", start)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		s.abort(key)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.responses[key] = &r
+	s.mu.Unlock()
+	return &r, nil
+}
+
+func (s *idempotencyStore) abort(key string) {
+	s.mu.Lock()
+	if r, ok := s.responses[key]; ok && r.pending {
+		delete(s.responses, key)
+	}
+	s.mu.Unlock()
+}
+
+func (s *idempotencyStore) complete(ctx context.Context, r *idempotentResponse) error {
+	s.mu.Lock()
+	s.responses[r.Key] = r
+	s.mu.Unlock()
+
+	start := time.Now()
+	defer observeQuery("idempotency_store", start)
+	_, err := s.db().ExecContext(ctx,
+		`INSERT INTO idempotency_keys(idempotency_key,fingerprint,status,content_type,body,created_at) VALUES (?,?,?,?,?,?) ON DUPLICATE KEY UPDATE fingerprint=VALUES(fingerprint),status=VALUES(status),content_type=VALUES(content_type),body=VALUES(body),created_at=VALUES(created_at)`,
+		r.Key, r.Fingerprint, r.Status, r.ContentType, r.Body, r.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// sweep 期限切れのレスポンスを捨てる
+func (s *idempotencyStore) sweep(now time.Time) {
+	s.mu.Lock()
+	for key, r := range s.responses {
+		if !r.pending && r.expired(now) {
+			delete(s.responses, key)
+		}
+	}
+	s.mu.Unlock()
+	if _, err := s.db().Exec(`DELETE FROM idempotency_keys WHERE created_at<?`, now.Add(-idempotencyWindow).UTC()); err != nil {
+		log.Printf("idempotency: sweep: %v", err)
+	}
+}
+
+func sweepIdempotency(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		chairIdempotency.sweep(now)
+		estateIdempotency.sweep(now)
+	}
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent Idempotency-Keyヘッダが付いたリクエストは最初のレスポンスをリプレイする
+func idempotent(store *idempotencyStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(headerIdempotencyKey)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > 255 {
+				return errBadRequest("idempotency key is too long")
+			}
+
+			body, err := ioutil.ReadAll(c.Request().Body)
+			if err != nil {
+				return errBadRequest("invalid request body")
+			}
+			c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+			h := sha256.New()
+			h.Write([]byte(c.Request().Method + " " + c.Request().URL.Path + "\n"))
+			h.Write(body)
+			fingerprint := hex.EncodeToString(h.Sum(nil))
+
+			prev, err := store.begin(c.Request().Context(), key, fingerprint)
+			if err != nil {
+				return errInternal(err)
+			}
+			if prev != nil {
+				if prev.Fingerprint != fingerprint {
+					return errUnprocessable("idempotency key was used with a different request")
+				}
+				if prev.pending {
+					return errConflict("a request with the same idempotency key is in progress")
+				}
+				if prev.ContentType != "" {
+					c.Response().Header().Set(echo.HeaderContentType, prev.ContentType)
+				}
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				c.Response().WriteHeader(prev.Status)
+				_, err := c.Response().Write(prev.Body)
+				return err
+			}
+
+			// ハンドラがpanicしても処理中の印が残らないようにする。completeした後なら何もしない
+			defer store.abort(key)
+
+			rec := &bodyRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+			if err := next(c); err != nil {
+				// 4xxもリプレイできるようにここでエラーレスポンスを書き出して記録する
+				c.Error(err)
+			}
+			c.Response().Writer = rec.ResponseWriter
+
+			status := c.Response().Status
+			// 5xxはリトライで成功しうるので記録しない
+			if status >= http.StatusInternalServerError {
+				store.abort(key)
+				return nil
+			}
+			pendingWrites.Add(1)
+			defer pendingWrites.Done()
+			// タイムアウトしたクライアントの接続が切れてもリトライに備えて保存できるよう、リクエストのcontextは使わない
+			ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			defer cancel()
+			err = store.complete(ctx, &idempotentResponse{
+				Key:         key,
+				Fingerprint: fingerprint,
+				Status:      status,
+				ContentType: c.Response().Header().Get(echo.HeaderContentType),
+				// 本文のないレスポンスでもNULLにならないように空のスライスにする
+				Body:      append([]byte{}, rec.body.Bytes()...),
+				CreatedAt: time.Now(),
+			})
+			if err != nil {
+				// レスポンスは返してしまったので、メモリ上の記録だけでリプレイする
+				c.Logger().Errorf("idempotency: store %s: %v", key, err)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// systemdの渡すファイルディスクリプタは3番から始まる
+const listenFdsStart = 3
+
+// ListenConfig どこでリクエストを受けるか。環境変数(env.sh)で設定する
+type ListenConfig struct {
+	// UnixPath unixソケットのパス。空なら使わない
+	UnixPath  string
+	UnixMode  os.FileMode
+	UnixOwner string
+	// TCPAddr "host:port"。空なら使わない
+	TCPAddr string
+}
+
+// NewListenConfigFromEnv LISTEN_UNIX, LISTEN_UNIX_MODE, LISTEN_UNIX_OWNER, LISTEN_TCPを読む。
+// 何も指定しなければ今まで通り/var/run/app.sockだけで受ける
+func NewListenConfigFromEnv() (ListenConfig, error) {
+	conf := ListenConfig{
+		UnixPath:  getEnv("LISTEN_UNIX", "/var/run/app.sock"),
+		UnixOwner: os.Getenv("LISTEN_UNIX_OWNER"),
+		TCPAddr:   os.Getenv("LISTEN_TCP"),
+	}
+	if conf.UnixPath == "off" {
+		conf.UnixPath = ""
+	}
+	if conf.TCPAddr == "" && os.Getenv("SERVER_PORT") != "" {
+		conf.TCPAddr = ":" + os.Getenv("SERVER_PORT")
+	}
+
+	mode, err := strconv.ParseUint(getEnv("LISTEN_UNIX_MODE", "0777"), 8, 32)
+	if err != nil {
+		return conf, fmt.Errorf("invalid LISTEN_UNIX_MODE: %v", err)
+	}
+	conf.UnixMode = os.FileMode(mode)
+
+	if conf.UnixPath == "" && conf.TCPAddr == "" {
+		return conf, errors.New("no listener configured: set LISTEN_UNIX or LISTEN_TCP")
+	}
+	return conf, nil
+}
+
+// adminFdName LISTEN_FDNAMESで管理用のリスナーに付ける名前
+const adminFdName = "admin"
+
+// listenerSet echoのhttp.Serverでそれぞれ受けるリスナー
+type listenerSet struct {
+	listeners []net.Listener
+	// admin ADMIN_LISTENのリスナー。親から引き継いだときだけ入っている
+	admin net.Listener
+	// systemd systemdから渡されたソケット。ソケットファイルはsystemdが管理する
+	systemd bool
+}
+
+func (ls listenerSet) String() string {
+	addrs := make([]string, 0, len(ls.listeners))
+	for _, l := range ls.listeners {
+		addrs = append(addrs, l.Addr().Network()+":"+l.Addr().String())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// Listen 親プロセスかsystemdから渡されたソケットがあればそれを使い、なければ設定通りに作る
+func (conf ListenConfig) Listen() (listenerSet, error) {
+	inherited, admin, systemd, err := inheritedListeners()
+	if err != nil {
+		return listenerSet{}, err
+	}
+	if len(inherited) > 0 {
+		return listenerSet{listeners: inherited, admin: admin, systemd: systemd}, nil
+	}
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	if conf.UnixPath != "" {
+		l, err := listenUnix(conf.UnixPath, conf.UnixMode, conf.UnixOwner)
+		if err != nil {
+			return listenerSet{}, err
+		}
+		listeners = append(listeners, l)
+	}
+	if conf.TCPAddr != "" {
+		l, err := net.Listen("tcp", conf.TCPAddr)
+		if err != nil {
+			closeAll()
+			return listenerSet{}, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listenerSet{listeners: listeners}, nil
+}
+
+func listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// go runユーザとnginxのユーザ（グループ）を同じにすれば777じゃなくてok
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner "user"か"user:group"をuidとgidにする。数値も受け付ける
+func lookupOwner(owner string) (int, int, error) {
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+
+	uid, gid := -1, -1
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			if u, err = user.LookupId(name); err != nil {
+				return 0, 0, fmt.Errorf("invalid LISTEN_UNIX_OWNER: %v", err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, fmt.Errorf("invalid LISTEN_UNIX_OWNER: %v", err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// inheritedListeners systemdがLISTEN_PIDとLISTEN_FDSで、または再起動前のプロセスがLISTEN_FDSとUPGRADE_PPIDで渡したソケットを受け取る。
+// LISTEN_FDNAMESで"admin"と名前の付いたものは管理用のリスナーとして分けて返す
+func inheritedListeners() ([]net.Listener, net.Listener, bool, error) {
+	systemd := os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid())
+	upgraded := os.Getenv(envUpgradePPID) != "" && os.Getenv(envUpgradePPID) == strconv.Itoa(os.Getppid())
+	if !systemd && !upgraded {
+		return nil, nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, false, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// 子プロセスに引き継がないよう消しておく
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	var admin net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if admin != nil {
+				admin.Close()
+			}
+			return nil, nil, false, fmt.Errorf("LISTEN_FDS: fd %d: %v", fd, err)
+		}
+		if i < len(names) && names[i] == adminFdName {
+			admin = l
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, admin, systemd, nil
+}
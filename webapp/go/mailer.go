@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail 送信するメール
+type Mail struct {
+	To      string
+	ReplyTo string
+	Subject string
+	Body    string
+}
+
+// headerValue ヘッダインジェクションを防ぐため改行を取り除く
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func (m Mail) bytes(from string, now time.Time) []byte {
+	b := strings.Builder{}
+	b.WriteString("From: " + headerValue(from) + "\r\n")
+	b.WriteString("To: " + headerValue(m.To) + "\r\n")
+	if m.ReplyTo != "" {
+		b.WriteString("Reply-To: " + headerValue(m.ReplyTo) + "\r\n")
+	}
+	b.WriteString("Subject: " + mime.QEncoding.Encode("UTF-8", headerValue(m.Subject)) + "\r\n")
+	b.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return []byte(b.String())
+}
+
+// Mailer メールの配送方法
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// smtpMailer SMTPサーバに配送する。応答しないサーバで止まらないよう、接続から送信の終わりまでをtimeoutで切る
+type smtpMailer struct {
+	addr    string
+	from    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// Send smtp.SendMailと同じ手順で送る。smtp.SendMailにはタイムアウトを指定できない
+func (s *smtpMailer) Send(m Mail) error {
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.bytes(s.from, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// outboxMailer ディレクトリにemlファイルとして書き出す。ローカルでの確認用
+type outboxMailer struct {
+	dir  string
+	from string
+}
+
+func (o *outboxMailer) Send(m Mail) error {
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d-%s.eml", now.UnixNano(), strings.Replace(m.To, "/", "_", -1))
+	tmp := filepath.Join(o.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, m.bytes(o.from, now), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(o.dir, name))
+}
+
+// NewMailerFromEnv MAILERにsmtpかoutbox(デフォルト)を指定する。SMTP_TIMEOUTで1通の送信にかける時間を変えられる
+func NewMailerFromEnv() (Mailer, error) {
+	from := getEnv("MAIL_FROM", "isuumo@localhost")
+	switch kind := getEnv("MAILER", "outbox"); kind {
+	case "smtp":
+		addr := getEnv("SMTP_ADDR", "127.0.0.1:25")
+		timeout, err := time.ParseDuration(getEnv("SMTP_TIMEOUT", "10s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_TIMEOUT: %v", err)
+		}
+		s := &smtpMailer{addr: addr, from: from, timeout: timeout}
+		if user := os.Getenv("SMTP_USER"); user != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			s.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)
+		}
+		return s, nil
+	case "outbox":
+		return &outboxMailer{dir: getEnv("OUTBOX_DIR", "outbox"), from: from}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", kind)
+	}
+}
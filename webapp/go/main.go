@@ -1,23 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/goccy/go-json"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -38,7 +39,9 @@ func JSON(c echo.Context, code int, i interface{}) error {
 }
 
 type InitializeResponse struct {
-	Language string `json:"language"`
+	Language string       `json:"language"`
+	Estate   []LoadResult `json:"estate"`
+	Chair    []LoadResult `json:"chair"`
 }
 
 type Chair struct {
@@ -142,6 +145,8 @@ type BoundingBox struct {
 }
 
 type MySQLConnectionEnv struct {
+	// Name クエリの記録に使う名前
+	Name     string
 	Host     string
 	Port     string
 	User     string
@@ -209,6 +214,7 @@ func (r *RecordMapper) Err() error {
 
 func NewEstateMySQLConnectionEnv() MySQLConnectionEnv {
 	return MySQLConnectionEnv{
+		Name:     "estate",
 		Host:     getEnv("MYSQL_ESTATE_HOST", "127.0.0.1"),
 		Port:     getEnv("MYSQL_ESTATE_PORT", "3306"),
 		User:     getEnv("MYSQL_ESTATE_USER", "isucon"),
@@ -219,6 +225,7 @@ func NewEstateMySQLConnectionEnv() MySQLConnectionEnv {
 
 func NewChairMySQLConnectionEnv() MySQLConnectionEnv {
 	return MySQLConnectionEnv{
+		Name:     "chair",
 		Host:     getEnv("MYSQL_CHAIR_HOST", "127.0.0.1"),
 		Port:     getEnv("MYSQL_CHAIR_PORT", "3306"),
 		User:     getEnv("MYSQL_CHAIR_USER", "isucon"),
@@ -237,8 +244,8 @@ func getEnv(key, defaultValue string) string {
 
 //ConnectDB isuumoデータベースに接続する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := strings.Join([]string{mc.User, ":", mc.Password, "@tcp(", mc.Host, ":", mc.Port, ")/", mc.DBName}, "")
-	return sqlx.Open("mysql", dsn)
+	dsn := strings.Join([]string{mc.User, ":", mc.Password, "@tcp(", mc.Host, ":", mc.Port, ")/", mc.DBName, "?parseTime=true"}, "")
+	return openTimedDB(mc.Name, dsn)
 }
 
 func init() {
@@ -255,12 +262,15 @@ func init() {
 		os.Exit(1)
 	}
 	json.Unmarshal(jsonText, &estateSearchCondition)
+	chairSearchConditionJSON = newStaticJSON(chairSearchCondition)
+	estateSearchConditionJSON = newStaticJSON(estateSearchCondition)
 
 	recommendCacheMux = sync.RWMutex{}
 	reset()
 }
 
-var estatesPool = sync.Pool{
+var estatesPool = countedPool{
+	Name: "estates",
 	New: func() interface{} {
 		return make([]Estate, 0, 100)
 	},
@@ -271,7 +281,8 @@ func putEstatesPool(estates []Estate) {
 	estatesPool.Put(estates)
 }
 
-var IDsPool = sync.Pool{
+var IDsPool = countedPool{
+	Name: "IDs",
 	New: func() interface{} {
 		return make([]int64, 0, 100)
 	},
@@ -282,7 +293,8 @@ func putIDsPool(estateIDs []int64) {
 	IDsPool.Put(estateIDs)
 }
 
-var chairsPool = sync.Pool{
+var chairsPool = countedPool{
+	Name: "chairs",
 	New: func() interface{} {
 		return make([]Chair, 0, 100)
 	},
@@ -299,8 +311,12 @@ var chairMap sync.Map
 func reset() {
 	resetChair()
 	resetLowPriced()
+	resetIdempotency()
+	resetRecommendChair()
 	estateMap = sync.Map{}
 	chairMap = sync.Map{}
+	estateSearchIndex.load(nil)
+	chairSearchIndex.load(nil)
 }
 
 var lowPriced sync.Map
@@ -312,8 +328,14 @@ func resetLowPriced() {
 var recommendCache map[int]EstateListResponse
 var recommendCacheMux sync.RWMutex
 
+// recommendCacheGen 計算中に無効化されたときに古い結果を書き込まないための世代
+var recommendCacheGen uint64
+
 func resetChair() {
+	recommendCacheMux.Lock()
 	recommendCache = make(map[int]EstateListResponse)
+	recommendCacheGen++
+	recommendCacheMux.Unlock()
 }
 
 func main() {
@@ -322,9 +344,31 @@ func main() {
 	// e.Debug = true
 	// e.Logger.SetLevel(log.DEBUG)
 
+	e.HTTPErrorHandler = httpErrorHandler
+
 	// Middleware
 	// e.Use(middleware.Logger())
-	// e.Use(middleware.Recover())
+	e.Use(middleware.RequestID())
+	var err error
+	if accessLog, err = NewAccessLoggerFromEnv(); err != nil {
+		e.Logger.Fatalf("access log: %v", err)
+	} else if accessLog != nil {
+		e.Use(accessLog.middleware)
+	}
+	e.Use(metricsMiddleware)
+	// panicした500もアクセスログとメトリクスに残るよう、それらの内側で回復する
+	e.Use(middleware.Recover())
+	if bots, err := NewBotBlockerFromEnv(); err != nil {
+		e.Logger.Fatalf("bot rules: %v", err)
+	} else if bots != nil {
+		e.Use(bots.middleware)
+	}
+	if limiter, err := NewRateLimiterFromEnv(); err != nil {
+		e.Logger.Fatalf("rate limit: %v", err)
+	} else if limiter != nil {
+		e.Use(limiter.middleware)
+	}
+	e.Use(requireReady)
 
 	// Initialize
 	e.POST("/initialize", initialize)
@@ -335,22 +379,44 @@ func main() {
 	e.GET("/api/chair/search", searchChairs)
 	e.GET("/api/chair/low_priced", getLowPricedChair)
 	e.GET("/api/chair/search/condition", getChairSearchCondition)
-	e.POST("/api/chair/buy/:id", buyChair)
+	e.POST("/api/chair/buy/:id", buyChair, idempotent(chairIdempotency))
 
 	// Estate Handler
 	e.GET("/api/estate/:id", getEstateDetail)
 	e.POST("/api/estate", postEstate)
 	e.GET("/api/estate/search", searchEstates)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
-	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
+	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument, idempotent(estateIdempotency))
 	e.POST("/api/estate/nazotte", searchEstateNazotte)
+	e.GET("/api/estate/near", searchEstateNear)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
 	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
+	e.GET("/api/recommended_chair/:estateId", searchRecommendedChairWithEstate)
+
+	// Health Handler
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+	e.GET("/metrics", getMetrics)
+
+	// Admin Handler
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	adminListen := os.Getenv("ADMIN_LISTEN")
+	// トークンがなければ403を返すが、/api/ordersなどはパスとして残しておく
+	registerAdminRoutes(e, false)
+
+	registerRouteTemplates(e)
+
+	if t := os.Getenv("SLOW_QUERY_THRESHOLD"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			e.Logger.Fatalf("invalid SLOW_QUERY_THRESHOLD : %v", err)
+		}
+		slowQueryThreshold = d
+	}
 
 	estateMySQLConnectionData = NewEstateMySQLConnectionEnv()
 	chairMySQLConnectionData = NewChairMySQLConnectionEnv()
 
-	var err error
 	estateDb, err = estateMySQLConnectionData.ConnectDB()
 	if err != nil {
 		e.Logger.Fatalf("DB connection failed : %v", err)
@@ -367,29 +433,66 @@ func main() {
 	chairDb.SetMaxIdleConns(200)
 	defer chairDb.Close()
 
-	// ここからソケット接続設定 ---
-	socket_file := "/var/run/app.sock"
-	os.Remove(socket_file)
+	if w := os.Getenv("IDEMPOTENCY_WINDOW"); w != "" {
+		idempotencyWindow, err = time.ParseDuration(w)
+		if err != nil {
+			e.Logger.Fatalf("invalid IDEMPOTENCY_WINDOW : %v", err)
+		}
+	}
+	go sweepIdempotency(time.Minute)
+
+	mailer, err = NewMailerFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("mailer configuration failed : %v", err)
+	}
+	documentRequestRecipient = getEnv("DOCUMENT_REQUEST_TO", "agent@localhost")
+	pendingWrites.Add(1)
+	go func() {
+		defer pendingWrites.Done()
+		runDocumentRequestWorker(5 * time.Second)
+	}()
+
+	// 再起動後に空のマップで応答しないよう、読み込みが終わるまでrequireReadyで503を返す
+	loaded := make(chan struct{})
+	go func() {
+		runWarmStart()
+		close(loaded)
+	}()
 
-	l, err := net.Listen("unix", socket_file)
+	listenConf, err := NewListenConfigFromEnv()
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
-
-	// go runユーザとnginxのユーザ（グループ）を同じにすれば777じゃなくてok
-	err = os.Chmod(socket_file, 0777)
+	l, err := listenConf.Listen()
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
+	e.Logger.Printf("listening on %s", l)
+
+	if adminListen != "" {
+		if err := startAdminServer(adminListen, &l, httpErrorHandler); err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.Logger.Printf("admin endpoints listening on %s", adminListen)
+	}
+
+	if t := os.Getenv("SHUTDOWN_TIMEOUT"); t != "" {
+		shutdownTimeout, err = time.ParseDuration(t)
+		if err != nil {
+			e.Logger.Fatalf("invalid SHUTDOWN_TIMEOUT : %v", err)
+		}
+	}
 
-	e.Listener = l
-	// ここまで ---
 	// Start server
-	// serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
-	e.Logger.Fatal(e.Start(""))
+	if err := serve(e, l, loaded); err != nil {
+		e.Logger.Fatal(err)
+	}
 }
 
 func initialize(c echo.Context) error {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	setReady(false)
 	reset()
 	sqlDir := filepath.Join("..", "mysql", "db")
 	estatePaths := []string{
@@ -402,72 +505,42 @@ func initialize(c echo.Context) error {
 		filepath.Join(sqlDir, "2_DummyChairData.sql"),
 	}
 
+	var res InitializeResponse
+	res.Language = "go"
+	// クライアントが途中で切っても読み込みを最後まで終わらせる
+	ctx := context.Background()
 	eg := errgroup.Group{}
 	eg.Go(func() error {
-		for _, p := range estatePaths {
-			sqlFile, _ := filepath.Abs(p)
-			cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
-				estateMySQLConnectionData.Host,
-				estateMySQLConnectionData.User,
-				estateMySQLConnectionData.Password,
-				estateMySQLConnectionData.Port,
-				estateMySQLConnectionData.DBName,
-				sqlFile,
-			)
-			if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-				return err
-			}
-		}
-		return nil
+		var err error
+		res.Estate, err = loadSQLFiles(ctx, estateDb, estateMySQLConnectionData, estatePaths)
+		return err
 	})
 	eg.Go(func() error {
-		for _, p := range chairPaths {
-			sqlFile, _ := filepath.Abs(p)
-			cmdStr := fmt.Sprintf("mysql -h %v -u %v -p%v -P %v %v < %v",
-				chairMySQLConnectionData.Host,
-				chairMySQLConnectionData.User,
-				chairMySQLConnectionData.Password,
-				chairMySQLConnectionData.Port,
-				chairMySQLConnectionData.DBName,
-				sqlFile,
-			)
-			if err := exec.Command("bash", "-c", cmdStr).Run(); err != nil {
-				return err
-			}
-		}
-		return nil
+		var err error
+		res.Chair, err = loadSQLFiles(ctx, chairDb, chairMySQLConnectionData, chairPaths)
+		return err
 	})
 	if err := eg.Wait(); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Errorf("initialize: %v", err)
+		// 503のままにならないよう、MySQLに残っている内容かスナップショットで読み直す
+		go runWarmStart()
+		return JSON(c, http.StatusInternalServerError, res)
 	}
 
-	var estates []Estate
-	query := `SELECT id,name,description,thumbnail,address,latitude,longitude,rent,door_height,door_width,features,popularity FROM estate`
-	err := estateDb.Select(&estates, query)
+	estates, chairs, err := selectAll(ctx)
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		go runWarmStart()
+		return errInternal(err)
 	}
+	saveSnapshot(estates, chairs)
+	storeAll(estates, chairs)
+	setReady(true)
 
-	for _, estate := range estates {
-		estateMap.Store(estate.ID, estate)
-	}
-
-	var chairs []Chair
-	query = `SELECT id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock FROM chair`
-	err = chairDb.Select(&chairs, query)
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	for _, chair := range chairs {
-		chairMap.Store(chair.ID, chair)
-	}
-
-	return JSON(c, http.StatusOK, InitializeResponse{
-		Language: "go",
-	})
+	return JSON(c, http.StatusOK, res)
 }
 
-var chairPool = sync.Pool{
+var chairPool = countedPool{
+	Name: "chair",
 	New: func() interface{} {
 		return Chair{}
 	},
@@ -476,26 +549,26 @@ var chairPool = sync.Pool{
 func getChairDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidID("id")
 	}
 
 	if val, ok := chairMap.Load(int64(id)); ok {
 		if (val.(Chair)).Stock == 0 {
-			return c.NoContent(http.StatusNotFound)
+			return errNotFound("chair")
 		}
-		return JSON(c, http.StatusOK, val)
+		return ETagJSON(c, val)
 	}
-	return c.NoContent(http.StatusNotFound)
+	return errNotFound("chair")
 }
 
 func postChair(c echo.Context) error {
 	header, err := c.FormFile("chairs")
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParam(&paramError{Field: "chairs", Reason: "file is required"})
 	}
 	f, err := header.Open()
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(err)
 	}
 	defer f.Close()
 	reader := csv.NewReader(f)
@@ -504,12 +577,11 @@ func postChair(c echo.Context) error {
 	reader.FieldsPerRecord = 13
 	records, err := reader.ReadAll()
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errBadRequest("invalid csv")
 	}
 
-	query := strings.Builder{}
-	query.WriteString("INSERT INTO chair(id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock) VALUES")
-	for idx, row := range records {
+	chairs := make([]Chair, 0, len(records))
+	for _, row := range records {
 		rm := RecordMapper{Record: row}
 		id := rm.NextInt()
 		name := rm.NextString()
@@ -525,14 +597,9 @@ func postChair(c echo.Context) error {
 		popularity := rm.NextInt()
 		stock := rm.NextInt()
 		if err := rm.Err(); err != nil {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		if idx > 0 {
-			query.WriteString(",")
+			return errBadRequest("invalid csv record")
 		}
-		query.WriteString(fmt.Sprintf(`(%d,"%s","%s","%s",%d,%d,%d,%d,"%s","%s","%s",%d,%d)`, id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock))
-
-		chairMap.Store(int64(id), Chair{
+		chairs = append(chairs, Chair{
 			ID:          int64(id),
 			Name:        name,
 			Description: description,
@@ -548,124 +615,32 @@ func postChair(c echo.Context) error {
 			Stock:       int64(stock),
 		})
 	}
-	_, err = chairDb.Exec(query.String())
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	if err := insertChairs(c.Request().Context(), chairs); err != nil {
+		return errInternal(err)
 	}
-	resetChair()
+	// DBへのコミットが成功してからメモリに反映する。
+	// 購入はchairMapにある椅子しか扱わないので、先にインデックスに入れておけばlowerStockを取りこぼさない
+	chairSearchIndex.add(chairs)
+	for _, chair := range chairs {
+		chairMap.Store(chair.ID, chair)
+	}
+	// 椅子ごとのおすすめ物件は他の椅子が増えても変わらないので捨てない
+	resetRecommendChair()
 	lowPriced.Delete("chair")
 	return c.NoContent(http.StatusCreated)
 }
 
 func searchChairs(c echo.Context) error {
-	queryCondition := builderPool.Get().(*strings.Builder)
-	defer putBuilderPool(queryCondition)
-
-	if c.QueryParam("priceRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("p=")
-		queryCondition.WriteString(c.QueryParam("priceRangeId"))
-	}
-
-	if c.QueryParam("heightRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("h=")
-		queryCondition.WriteString(c.QueryParam("heightRangeId"))
-	}
-
-	if c.QueryParam("widthRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("w=")
-		queryCondition.WriteString(c.QueryParam("widthRangeId"))
-	}
-
-	if c.QueryParam("depthRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("d=")
-		queryCondition.WriteString(c.QueryParam("depthRangeId"))
-	}
-
-	if c.QueryParam("kind") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("kind='")
-		queryCondition.WriteString(c.QueryParam("kind"))
-		queryCondition.WriteString("'")
-	}
-
-	if c.QueryParam("color") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("color='")
-		queryCondition.WriteString(c.QueryParam("color"))
-		queryCondition.WriteString("'")
-	}
-
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			if queryCondition.Len() > 0 {
-				queryCondition.WriteString(" AND ")
-			}
-			queryCondition.WriteString("FIND_IN_SET('")
-			queryCondition.WriteString(f)
-			queryCondition.WriteString("',f)>0")
-		}
-	}
-
-	if queryCondition.Len() == 0 {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	queryCondition.WriteString(" AND stock>0 ")
-
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	params, err := parseChairSearchParams(c)
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
-	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	searchQuery := "SELECT id FROM chair WHERE "
-	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	limitOffset := fmt.Sprintf(" ORDER BY popularity DESC, id ASC LIMIT %d OFFSET %d", perPage, page*perPage)
-
-	var res ChairSearchResponse
-	err = chairDb.Get(&res.Count, countQuery+queryCondition.String())
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	chairIDs := IDsPool.Get().([]int64)
-	defer putIDsPool(chairIDs)
-	err = chairDb.Select(&chairIDs, searchQuery+queryCondition.String()+limitOffset)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return JSON(c, http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
-		}
-		return c.NoContent(http.StatusInternalServerError)
+		return errInvalidParam(err)
 	}
 
 	chairs := chairsPool.Get().([]Chair)
 	defer putChairsPool(chairs)
-	for _, id := range chairIDs {
-		val, _ := chairMap.Load(id)
-		chairs = append(chairs, val.(Chair))
-	}
 
-	res.Chairs = chairs
+	var res ChairSearchResponse
+	res.Count, res.Chairs = chairSearchIndex.search(&params, chairs)
 
 	return JSON(c, http.StatusOK, res)
 }
@@ -673,30 +648,31 @@ func searchChairs(c echo.Context) error {
 func buyChair(c echo.Context) error {
 	m := echo.Map{}
 	if err := c.Bind(&m); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errBadRequest("invalid request body")
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParam(&paramError{Field: "email", Reason: "required"})
+	}
+	if err := validateEmail("email", email); err != nil {
+		return errInvalidParam(err)
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidID("id")
 	}
 
-	_chair, ok := chairMap.Load(int64(id))
-	if !ok {
-		return c.NoContent(http.StatusNotFound)
-	}
-	chair := _chair.(Chair)
-	chair.Stock--
-	chairMap.Store(int64(id), chair)
-
-	_, err = chairDb.Exec(fmt.Sprintf("UPDATE chair SET stock=stock-1 WHERE id=%s", c.Param("id")))
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	_, err = purchaseChair(c.Request().Context(), int64(id), email)
+	switch err {
+	case nil:
+	case errChairNotFound:
+		return errNotFound("chair")
+	case errOutOfStock:
+		return errConflict("chair is out of stock")
+	default:
+		return errInternal(err)
 	}
 	lowPriced.Delete("chair")
 
@@ -704,22 +680,26 @@ func buyChair(c echo.Context) error {
 }
 
 func getChairSearchCondition(c echo.Context) error {
-	return JSON(c, http.StatusOK, chairSearchCondition)
+	return chairSearchConditionJSON.serve(c)
 }
 
 func getLowPricedChair(c echo.Context) error {
 	if val, ok := lowPriced.Load("chair"); ok {
+		lowPricedChairCache.hit()
 		return JSON(c, http.StatusOK, ChairListResponse{Chairs: val.([]Chair)})
 	}
+	lowPricedChairCache.miss()
 	chairIDs := IDsPool.Get().([]int64)
 	defer putIDsPool(chairIDs)
 	query := `SELECT id FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT 20`
-	err := chairDb.Select(&chairIDs, query)
+	start := time.Now()
+	err := chairDb.SelectContext(c.Request().Context(), &chairIDs, query)
+	observeQuery("low_priced_chair", start)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return JSON(c, http.StatusOK, ChairListResponse{[]Chair{}})
 		}
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(err)
 	}
 	chairs := make([]Chair, len(chairIDs))
 	for idx, id := range chairIDs {
@@ -734,22 +714,22 @@ func getLowPricedChair(c echo.Context) error {
 func getEstateDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidID("id")
 	}
 	if val, ok := estateMap.Load(int64(id)); ok {
-		return JSON(c, http.StatusOK, val)
+		return ETagJSON(c, val)
 	}
-	return c.NoContent(http.StatusNotFound)
+	return errNotFound("estate")
 }
 
 func postEstate(c echo.Context) error {
 	header, err := c.FormFile("estates")
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParam(&paramError{Field: "estates", Reason: "file is required"})
 	}
 	f, err := header.Open()
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(err)
 	}
 	defer f.Close()
 	reader := csv.NewReader(f)
@@ -758,12 +738,11 @@ func postEstate(c echo.Context) error {
 	reader.FieldsPerRecord = 12
 	records, err := reader.ReadAll()
 	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errBadRequest("invalid csv")
 	}
 
-	query := strings.Builder{}
-	query.WriteString("INSERT INTO estate(id,name,description,thumbnail,address,latitude,longitude,rent,door_height,door_width,features,popularity) VALUES")
-	for idx, row := range records {
+	estates := make([]Estate, 0, len(records))
+	for _, row := range records {
 		rm := RecordMapper{Record: row}
 		id := rm.NextInt()
 		name := rm.NextString()
@@ -778,14 +757,9 @@ func postEstate(c echo.Context) error {
 		features := rm.NextString()
 		popularity := rm.NextInt()
 		if err := rm.Err(); err != nil {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		if idx > 0 {
-			query.WriteString(",")
+			return errBadRequest("invalid csv record")
 		}
-		query.WriteString(fmt.Sprintf(`(%d,"%s","%s","%s","%s",%f,%f,%d,%d,%d,"%s",%d)`, id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity))
-
-		estateMap.Store(int64(id), Estate{
+		estates = append(estates, Estate{
 			ID:          int64(id),
 			Name:        name,
 			Description: description,
@@ -800,15 +774,20 @@ func postEstate(c echo.Context) error {
 			Popularity:  int64(popularity),
 		})
 	}
-	_, err = estateDb.Exec(query.String())
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	if err := insertEstates(c.Request().Context(), estates); err != nil {
+		return errInternal(err)
 	}
+	for _, estate := range estates {
+		estateMap.Store(estate.ID, estate)
+	}
+	estateSearchIndex.add(estates)
+	invalidateRecommendCache(estates)
 	lowPriced.Delete("estate")
 	return c.NoContent(http.StatusCreated)
 }
 
-var paramsPool = sync.Pool{
+var paramsPool = countedPool{
+	Name: "params",
 	New: func() interface{} {
 		return make([]interface{}, 0, 20)
 	},
@@ -819,110 +798,38 @@ func putParamsPool(params []interface{}) {
 	paramsPool.Put(params)
 }
 
-var conditionsPool = sync.Pool{
-	New: func() interface{} {
-		return make([]string, 0, 20)
-	},
-}
-
-func putConditionsPool(conditions []string) {
-	conditions = conditions[:0]
-	conditionsPool.Put(conditions)
-}
-
 func searchEstates(c echo.Context) error {
-	queryCondition := builderPool.Get().(*strings.Builder)
-	defer putBuilderPool(queryCondition)
-	if c.QueryParam("doorHeightRangeId") != "" {
-		queryCondition.WriteString("h=")
-		queryCondition.WriteString(c.QueryParam("doorHeightRangeId"))
-	}
-
-	if c.QueryParam("doorWidthRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("w=")
-		queryCondition.WriteString(c.QueryParam("doorWidthRangeId"))
-	}
-
-	if c.QueryParam("rentRangeId") != "" {
-		if queryCondition.Len() > 0 {
-			queryCondition.WriteString(" AND ")
-		}
-		queryCondition.WriteString("r=")
-		queryCondition.WriteString(c.QueryParam("rentRangeId"))
-	}
-
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			if queryCondition.Len() > 0 {
-				queryCondition.WriteString(" AND ")
-			}
-			queryCondition.WriteString("FIND_IN_SET('")
-			queryCondition.WriteString(f)
-			queryCondition.WriteString("',f)>0")
-		}
-	}
-
-	if queryCondition.Len() == 0 {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	params, err := parseEstateSearchParams(c)
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParam(err)
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
-	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	searchQuery := "SELECT id FROM estate WHERE "
-	countQuery := "SELECT COUNT(*) FROM estate WHERE "
-	limitOffset := fmt.Sprintf(" ORDER BY popularity DESC, id ASC LIMIT %d OFFSET %d", perPage, page*perPage)
-
-	var res EstateSearchResponse
-	err = estateDb.Get(&res.Count, countQuery+queryCondition.String())
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	estateIDs := IDsPool.Get().([]int64)
-	defer putIDsPool(estateIDs)
-	err = estateDb.Select(&estateIDs, searchQuery+queryCondition.String()+limitOffset)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return JSON(c, http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-		}
-		return c.NoContent(http.StatusInternalServerError)
-	}
 	estates := estatesPool.Get().([]Estate)
 	defer putEstatesPool(estates)
-	for _, id := range estateIDs {
-		val, _ := estateMap.Load(id)
-		estates = append(estates, val.(Estate))
-	}
 
-	res.Estates = estates
+	var res EstateSearchResponse
+	res.Count, res.Estates = estateSearchIndex.search(&params, estates)
 
 	return JSON(c, http.StatusOK, res)
 }
 
 func getLowPricedEstate(c echo.Context) error {
 	if val, ok := lowPriced.Load("estate"); ok {
+		lowPricedEstateCache.hit()
 		return JSON(c, http.StatusOK, EstateListResponse{Estates: val.([]Estate)})
 	}
+	lowPricedEstateCache.miss()
 	estateIDs := IDsPool.Get().([]int64)
 	defer putIDsPool(estateIDs)
 	query := `SELECT id FROM estate ORDER BY rent ASC, id ASC LIMIT 20`
-	err := estateDb.Select(&estateIDs, query)
+	start := time.Now()
+	err := estateDb.SelectContext(c.Request().Context(), &estateIDs, query)
+	observeQuery("low_priced_estate", start)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return JSON(c, http.StatusOK, EstateListResponse{[]Estate{}})
 		}
-		return c.NoContent(http.StatusInternalServerError)
+		return errInternal(err)
 	}
 	estates := make([]Estate, len(estateIDs))
 	for idx, id := range estateIDs {
@@ -938,107 +845,72 @@ func getLowPricedEstate(c echo.Context) error {
 func searchRecommendedEstateWithChair(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidID("id")
 	}
 
-	_chair, _ := chairMap.Load(int64(id))
-	chair := _chair.(Chair)
-
-	estateIDs := IDsPool.Get().([]int64)
-	defer putIDsPool(estateIDs)
-	w := chair.Width
-	h := chair.Height
-	d := chair.Depth
-	if w > h {
-		w, h = h, w
-	}
-	if h > d {
-		h, d = d, h
-	}
-	query := fmt.Sprintf(`SELECT id FROM estate WHERE (door_width>=%d AND door_height>=%d) OR (door_width>=%d AND door_height>=%d) ORDER BY popularity DESC, id ASC LIMIT 20`, w, h, h, w)
-	err = estateDb.Select(&estateIDs, query)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return JSON(c, http.StatusOK, EstateListResponse{[]Estate{}})
-		}
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	estates := estatesPool.Get().([]Estate)
-	defer putEstatesPool(estates)
-	for _, id := range estateIDs {
-		val, _ := estateMap.Load(id)
-		estates = append(estates, val.(Estate))
+	recommendCacheMux.RLock()
+	res, ok := recommendCache[id]
+	gen := recommendCacheGen
+	recommendCacheMux.RUnlock()
+	if ok {
+		recommendEstateCacheCounter.hit()
+		return JSON(c, http.StatusOK, res)
 	}
+	recommendEstateCacheCounter.miss()
 
-	return JSON(c, http.StatusOK, EstateListResponse{estates})
-}
+	_chair, ok := chairMap.Load(int64(id))
+	if !ok {
+		return errNotFound("chair")
+	}
+	res = EstateListResponse{Estates: estateSearchIndex.recommend(_chair.(Chair), Limit)}
 
-var emptyEstateSearchResponse = EstateSearchResponse{Count: 0, Estates: []Estate{}}
-var coordinatePool = sync.Pool{
-	New: func() interface{} {
-		return Coordinates{}
-	},
+	recommendCacheMux.Lock()
+	if gen == recommendCacheGen {
+		recommendCache[id] = res
+	}
+	recommendCacheMux.Unlock()
+	return JSON(c, http.StatusOK, res)
 }
 
-var estateSearchResponsePool = sync.Pool{
+var estateSearchResponsePool = countedPool{
+	Name: "estateSearchResponse",
 	New: func() interface{} {
 		return EstateSearchResponse{}
 	},
 }
 
 func searchEstateNazotte(c echo.Context) error {
-	coordinates := coordinatePool.Get().(Coordinates)
-	err := c.Bind(&coordinates)
+	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errBadRequest("invalid request body")
 	}
-
-	if len(coordinates.Coordinates) == 0 {
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	b := coordinates.getBoundingBox()
-	estateIDs := IDsPool.Get().([]int64)
-	defer putIDsPool(estateIDs)
-	txt := builderPool.Get().(*strings.Builder)
-	defer putBuilderPool(txt)
-	txt.WriteString("'POLYGON((")
-	for idx, c := range coordinates.Coordinates {
-		if idx > 0 {
-			txt.WriteRune(',')
-		}
-		txt.WriteString(fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
-	}
-	txt.WriteString("))'")
-
-	query := fmt.Sprintf(`SELECT id FROM estate WHERE latitude<=%f AND latitude>=%f AND longitude<=%f AND longitude>=%f AND ST_Contains(ST_PolygonFromText(%s),l) ORDER BY popularity DESC, id ASC LIMIT 50`, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Latitude, txt.String())
-	err = estateDb.Select(&estateIDs, query)
-	if err == sql.ErrNoRows {
-		return JSON(c, http.StatusOK, emptyEstateSearchResponse)
-	} else if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	shape, err := parseNazotteRequest(body)
+	if err != nil {
+		return errBadRequest("invalid polygon")
 	}
 
 	re := estateSearchResponsePool.Get().(EstateSearchResponse)
 	defer estateSearchResponsePool.Put(re)
 	re.Estates = estatesPool.Get().([]Estate)
 	defer putEstatesPool(re.Estates)
-	for _, id := range estateIDs {
-		val, _ := estateMap.Load(id)
-		re.Estates = append(re.Estates, val.(Estate))
-	}
+	re.Estates = estateSearchIndex.nazotte(shape, NazotteLimit, re.Estates)
 	re.Count = int64(len(re.Estates))
 
+	if wantsGeoJSON(c) {
+		return GeoJSON(c, http.StatusOK, newEstateFeatureCollection(re.Estates))
+	}
 	return JSON(c, http.StatusOK, re)
 }
 
-var mapPool = sync.Pool{
+var mapPool = countedPool{
+	Name: "map",
 	New: func() interface{} {
 		return echo.Map{}
 	},
 }
 
-var estatePool = sync.Pool{
+var estatePool = countedPool{
+	Name: "estate",
 	New: func() interface{} {
 		return Estate{}
 	},
@@ -1048,27 +920,33 @@ func postEstateRequestDocument(c echo.Context) error {
 	m := mapPool.Get().(echo.Map)
 	defer mapPool.Put(m)
 	if err := c.Bind(&m); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+		return errBadRequest("invalid request body")
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidParam(&paramError{Field: "email", Reason: "required"})
+	}
+	if err := validateEmail("email", email); err != nil {
+		return errInvalidParam(err)
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.NoContent(http.StatusBadRequest)
+		return errInvalidID("id")
 	}
 
-	if _, ok := estateMap.Load(int64(id)); ok {
-		return c.NoContent(http.StatusOK)
+	if _, ok := estateMap.Load(int64(id)); !ok {
+		return errNotFound("estate")
 	}
-	return c.NoContent(http.StatusNotFound)
+	if err := createDocumentRequest(c.Request().Context(), int64(id), email); err != nil {
+		return errInternal(err)
+	}
+	return c.NoContent(http.StatusOK)
 }
 
 func getEstateSearchCondition(c echo.Context) error {
-	return JSON(c, http.StatusOK, estateSearchCondition)
+	return estateSearchConditionJSON.serve(c)
 }
 
 func (cs Coordinates) getBoundingBox() BoundingBox {
@@ -1099,7 +977,8 @@ func (cs Coordinates) getBoundingBox() BoundingBox {
 	return boundingBox
 }
 
-var builderPool = sync.Pool{
+var builderPool = countedPool{
+	Name: "builder",
 	New: func() interface{} {
 		builder := &strings.Builder{}
 		builder.Grow(1024 * 1024)
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// durationBuckets レイテンシのヒストグラムの上限(秒)
+var durationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram Prometheusのヒストグラム。記録はロックを取らない
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sumNs  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	for i, le := range durationBuckets {
+		if s <= le {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNs, uint64(d))
+}
+
+// histogramVec ラベルの組ごとのヒストグラム
+type histogramVec struct {
+	mu         sync.RWMutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec() *histogramVec {
+	return &histogramVec{histograms: map[string]*histogram{}}
+}
+
+func (v *histogramVec) with(labels string) *histogram {
+	v.mu.RLock()
+	h, ok := v.histograms[labels]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.histograms[labels]; !ok {
+		h = newHistogram()
+		v.histograms[labels] = h
+	}
+	return h
+}
+
+// counterVec ラベルの組ごとのカウンタ
+type counterVec struct {
+	mu       sync.RWMutex
+	counters map[string]*uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{counters: map[string]*uint64{}}
+}
+
+func (v *counterVec) inc(labels string) {
+	v.mu.RLock()
+	c, ok := v.counters[labels]
+	v.mu.RUnlock()
+	if !ok {
+		v.mu.Lock()
+		if c, ok = v.counters[labels]; !ok {
+			c = new(uint64)
+			v.counters[labels] = c
+		}
+		v.mu.Unlock()
+	}
+	atomic.AddUint64(c, 1)
+}
+
+// labels ラベルを{a="b",c="d"}の中身の形にする
+func labels(kv ...string) string {
+	b := strings.Builder{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(kv[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func escapeLabelValue(s string) string {
+	if !strings.ContainsAny(s, "\\\"\n") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// cacheCounter キャッシュのヒット数とミス数
+type cacheCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *cacheCounter) hit()  { atomic.AddUint64(&c.hits, 1) }
+func (c *cacheCounter) miss() { atomic.AddUint64(&c.misses, 1) }
+
+var lowPricedChairCache cacheCounter
+var lowPricedEstateCache cacheCounter
+var recommendChairCacheCounter cacheCounter
+var recommendEstateCacheCounter cacheCounter
+
+// countedPool 取り出しのうちNewで作り直した回数を数えるsync.Pool
+type countedPool struct {
+	Name string
+	New  func() interface{}
+
+	pool   sync.Pool
+	hits   uint64
+	misses uint64
+}
+
+func (p *countedPool) Get() interface{} {
+	if v := p.pool.Get(); v != nil {
+		atomic.AddUint64(&p.hits, 1)
+		return v
+	}
+	atomic.AddUint64(&p.misses, 1)
+	return p.New()
+}
+
+func (p *countedPool) Put(x interface{}) {
+	p.pool.Put(x)
+}
+
+var countedPools = []*countedPool{
+	&estatesPool, &IDsPool, &chairsPool, &chairPool, &paramsPool,
+	&estateSearchResponsePool, &mapPool, &estatePool, &builderPool,
+}
+
+var (
+	httpRequests        = newCounterVec()
+	httpRequestDuration = newHistogramVec()
+	queryDuration       = newHistogramVec()
+)
+
+// observeQuery startからの時間を名前付きクエリのレイテンシとして記録する
+func observeQuery(name string, start time.Time) {
+	queryDuration.with(labels("query", name)).observe(time.Since(start))
+}
+
+// routeTemplates 登録済みのルート。マッチしなかったリクエストは生のパスになるので、ラベルが増えないようにまとめる
+var routeTemplates = map[string]bool{}
+
+func registerRouteTemplates(e *echo.Echo) {
+	for _, r := range e.Routes() {
+		routeTemplates[r.Path] = true
+	}
+}
+
+func routeTemplate(c echo.Context) string {
+	if routeTemplates[c.Path()] {
+		return c.Path()
+	}
+	return "unmatched"
+}
+
+// metricsMiddleware ルートのテンプレートごとにリクエスト数とレイテンシを記録する
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		if err := next(c); err != nil {
+			// ステータスコードを確定させるためにここでエラーレスポンスを書き出す
+			c.Error(err)
+		}
+		route := routeTemplate(c)
+		method := c.Request().Method
+		httpRequests.inc(labels("method", method, "route", route, "code", strconv.Itoa(c.Response().Status)))
+		httpRequestDuration.with(labels("method", method, "route", route)).observe(time.Since(start))
+		return nil
+	}
+}
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w metricsWriter) sample(name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func (w metricsWriter) counterVec(name, help string, v *counterVec) {
+	w.header(name, "counter", help)
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.mu.RLock()
+		c := v.counters[k]
+		v.mu.RUnlock()
+		w.sample(name, k, float64(atomic.LoadUint64(c)))
+	}
+}
+
+func (w metricsWriter) histogramVec(name, help string, v *histogramVec) {
+	w.header(name, "histogram", help)
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.histograms))
+	for k := range v.histograms {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.mu.RLock()
+		h := v.histograms[k]
+		v.mu.RUnlock()
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			w.sample(name+"_bucket", joinLabels(k, labels("le", formatFloat(le))), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&h.count)
+		w.sample(name+"_bucket", joinLabels(k, `le="+Inf"`), float64(count))
+		w.sample(name+"_sum", k, time.Duration(atomic.LoadUint64(&h.sumNs)).Seconds())
+		w.sample(name+"_count", k, float64(count))
+	}
+}
+
+func (w metricsWriter) poolStats(dbs map[string]sql.DBStats) {
+	names := []string{"estate", "chair"}
+	gauges := []struct {
+		name, help string
+		value      func(sql.DBStats) float64
+	}{
+		{"isuumo_db_max_open_connections", "Maximum number of open connections to the database.", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"isuumo_db_open_connections", "Number of established connections.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"isuumo_db_in_use_connections", "Number of connections currently in use.", func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"isuumo_db_idle_connections", "Number of idle connections.", func(s sql.DBStats) float64 { return float64(s.Idle) }},
+	}
+	counters := []struct {
+		name, help string
+		value      func(sql.DBStats) float64
+	}{
+		{"isuumo_db_wait_count_total", "Total number of connections waited for.", func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"isuumo_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+		{"isuumo_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.", func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+		{"isuumo_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.", func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+	}
+	for _, g := range gauges {
+		w.header(g.name, "gauge", g.help)
+		for _, n := range names {
+			w.sample(g.name, labels("db", n), g.value(dbs[n]))
+		}
+	}
+	for _, c := range counters {
+		w.header(c.name, "counter", c.help)
+		for _, n := range names {
+			w.sample(c.name, labels("db", n), c.value(dbs[n]))
+		}
+	}
+}
+
+// getMetrics Prometheusのテキスト形式でメトリクスを返す
+func getMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	w := metricsWriter{bufio.NewWriter(c.Response())}
+
+	w.counterVec("isuumo_http_requests_total", "Number of HTTP requests by route template and status code.", httpRequests)
+	w.histogramVec("isuumo_http_request_duration_seconds", "HTTP request latency by route template.", httpRequestDuration)
+	w.counterVec("isuumo_bot_rule_matches_total", "User-Agent rule matches by rule, action and whether it was a dry run.", botRuleMatches)
+	w.counterVec("isuumo_rate_limited_total", "Requests rejected by the rate limiter by route template.", rateLimitRejections)
+
+	w.poolStats(map[string]sql.DBStats{"estate": estateDb.Stats(), "chair": chairDb.Stats()})
+	w.histogramVec("isuumo_db_query_duration_seconds", "Latency of named queries.", queryDuration)
+
+	w.header("isuumo_cache_requests_total", "counter", "Cache lookups by result.")
+	caches := []struct {
+		name         string
+		hits, misses *uint64
+	}{
+		{"low_priced_chair", &lowPricedChairCache.hits, &lowPricedChairCache.misses},
+		{"low_priced_estate", &lowPricedEstateCache.hits, &lowPricedEstateCache.misses},
+		{"recommend_estate", &recommendEstateCacheCounter.hits, &recommendEstateCacheCounter.misses},
+		{"recommend_chair", &recommendChairCacheCounter.hits, &recommendChairCacheCounter.misses},
+	}
+	for _, cc := range caches {
+		w.sample("isuumo_cache_requests_total", labels("cache", cc.name, "result", "hit"), float64(atomic.LoadUint64(cc.hits)))
+		w.sample("isuumo_cache_requests_total", labels("cache", cc.name, "result", "miss"), float64(atomic.LoadUint64(cc.misses)))
+	}
+
+	w.header("isuumo_pool_gets_total", "counter", "sync.Pool gets by whether a pooled value was reused (hit) or newly allocated (miss).")
+	for _, p := range countedPools {
+		w.sample("isuumo_pool_gets_total", labels("pool", p.Name, "result", "hit"), float64(atomic.LoadUint64(&p.hits)))
+		w.sample("isuumo_pool_gets_total", labels("pool", p.Name, "result", "miss"), float64(atomic.LoadUint64(&p.misses)))
+	}
+
+	ready := 0.0
+	if isReady() {
+		ready = 1
+	}
+	w.header("isuumo_ready", "gauge", "Whether chairMap and estateMap are loaded.")
+	w.sample("isuumo_ready", "", ready)
+	w.header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.sample("go_goroutines", "", float64(runtime.NumGoroutine()))
+
+	return w.Flush()
+}
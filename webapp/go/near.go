@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	earthRadius = 6371008.8 // meters
+	// metersPerDegree 緯度1度あたりの距離
+	metersPerDegree = earthRadius * math.Pi / 180
+
+	nearMaxRadius = 100000
+	nearMaxK      = 100
+)
+
+// EstateWithDistance 地点からの距離(m)付きの物件
+type EstateWithDistance struct {
+	Estate
+	Distance float64 `json:"distance"`
+}
+
+type EstateNearResponse struct {
+	Count   int64                `json:"count"`
+	Estates []EstateWithDistance `json:"estates"`
+}
+
+func haversine(a, b Coordinate) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// radiusBoundingBox centerから半径radius(m)の円を囲む矩形
+func radiusBoundingBox(center Coordinate, radius float64) BoundingBox {
+	dLat := radius / metersPerDegree
+	dLng := 180.0
+	if cos := math.Cos((math.Abs(center.Latitude) + dLat) * math.Pi / 180); cos > 0 {
+		dLng = math.Min(180, dLat/cos)
+	}
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: center.Latitude - dLat, Longitude: center.Longitude - dLng},
+		BottomRightCorner: Coordinate{Latitude: center.Latitude + dLat, Longitude: center.Longitude + dLng},
+	}
+}
+
+// nearQuery /api/estate/nearの検証済みの条件
+type nearQuery struct {
+	Center Coordinate
+	Radius float64 // 0なら半径で絞らない
+	K      int
+	estateFilter
+}
+
+func parseFloatParam(c echo.Context, name string, min, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(c.QueryParam(name), 64)
+	if err != nil || math.IsNaN(v) || v < min || v > max {
+		return 0, &paramError{Field: name, Reason: "out of range"}
+	}
+	return v, nil
+}
+
+func parseNearQuery(c echo.Context) (nearQuery, error) {
+	var q nearQuery
+	var err error
+	if q.Center.Latitude, err = parseFloatParam(c, "lat", -90, 90); err != nil {
+		return q, err
+	}
+	if q.Center.Longitude, err = parseFloatParam(c, "lng", -180, 180); err != nil {
+		return q, err
+	}
+	if c.QueryParam("radius") == "" && c.QueryParam("k") == "" {
+		return q, &paramError{Field: "query", Reason: "radius or k is required"}
+	}
+	if c.QueryParam("radius") != "" {
+		if q.Radius, err = parseFloatParam(c, "radius", 0, nearMaxRadius); err != nil || q.Radius == 0 {
+			return q, &paramError{Field: "radius", Reason: "out of range"}
+		}
+	}
+	q.K = Limit
+	if s := c.QueryParam("k"); s != "" {
+		if q.K, err = strconv.Atoi(s); err != nil || q.K <= 0 || q.K > nearMaxK {
+			return q, &paramError{Field: "k", Reason: "out of range"}
+		}
+	}
+	q.estateFilter, err = parseEstateFilter(c)
+	return q, err
+}
+
+func sortByDistance(hits []EstateWithDistance) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Distance != hits[j].Distance {
+			return hits[i].Distance < hits[j].Distance
+		}
+		return hits[i].ID < hits[j].ID
+	})
+}
+
+// withinRadius 半径内で条件に合う物件を近い順に全件返す
+func (ei *estateIndex) withinRadius(center Coordinate, radius float64, f *estateFilter) []EstateWithDistance {
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+
+	match := ei.match(f)
+	b := radiusBoundingBox(center, radius)
+	var hits []EstateWithDistance
+	for _, i := range ei.grid.candidates(b) {
+		if !match.has(i) {
+			continue
+		}
+		e := ei.estates[i]
+		if d := haversine(center, Coordinate{Latitude: e.Latitude, Longitude: e.Longitude}); d <= radius {
+			hits = append(hits, EstateWithDistance{Estate: e, Distance: d})
+		}
+	}
+	sortByDistance(hits)
+	return hits
+}
+
+// nearest 条件に合う物件を近い順にk件返す。centerのマスから外側へ1周ずつ広げて探す
+func (ei *estateIndex) nearest(center Coordinate, k int, f *estateFilter) []EstateWithDistance {
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+
+	match := ei.match(f)
+	if match.count() == 0 {
+		return nil
+	}
+	origin := cellOf(center.Latitude, center.Longitude)
+	var hits []EstateWithDistance
+	visited := 0
+	visit := func(cell gridCell) {
+		ps, ok := ei.grid[cell]
+		if !ok {
+			return
+		}
+		visited++
+		for _, i := range ps {
+			if !match.has(i) {
+				continue
+			}
+			e := ei.estates[i]
+			d := haversine(center, Coordinate{Latitude: e.Latitude, Longitude: e.Longitude})
+			hits = append(hits, EstateWithDistance{Estate: e, Distance: d})
+		}
+	}
+	for ring := int64(0); visited < len(ei.grid); ring++ {
+		if (2*ring+1)*(2*ring+1) > 4*int64(len(ei.grid)) {
+			// 物件から遠すぎて周を広げるより全件を見た方が速い
+			hits = hits[:0]
+			match.each(func(i int) bool {
+				e := ei.estates[i]
+				hits = append(hits, EstateWithDistance{Estate: e, Distance: haversine(center, Coordinate{Latitude: e.Latitude, Longitude: e.Longitude})})
+				return true
+			})
+			break
+		}
+		if ring == 0 {
+			visit(origin)
+		} else {
+			for d := -ring; d <= ring; d++ {
+				visit(gridCell{lat: origin.lat - ring, lng: origin.lng + d})
+				visit(gridCell{lat: origin.lat + ring, lng: origin.lng + d})
+			}
+			for d := -ring + 1; d <= ring-1; d++ {
+				visit(gridCell{lat: origin.lat + d, lng: origin.lng - ring})
+				visit(gridCell{lat: origin.lat + d, lng: origin.lng + ring})
+			}
+		}
+		if len(hits) < k {
+			continue
+		}
+		// 次の周にある点はring周分のマスより遠いので、k番目がそれより近ければ打ち切れる
+		sortByDistance(hits)
+		hits = hits[:k]
+		maxLat := math.Min(89, math.Abs(center.Latitude)+float64(ring+1)*nazotteGridSize)
+		bound := float64(ring) * nazotteGridSize * metersPerDegree * math.Cos(maxLat*math.Pi/180)
+		if hits[k-1].Distance <= bound {
+			break
+		}
+	}
+	sortByDistance(hits)
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+func searchEstateNear(c echo.Context) error {
+	q, err := parseNearQuery(c)
+	if err != nil {
+		return errInvalidParam(err)
+	}
+
+	var res EstateNearResponse
+	if q.Radius > 0 {
+		hits := estateSearchIndex.withinRadius(q.Center, q.Radius, &q.estateFilter)
+		res.Count = int64(len(hits))
+		if len(hits) > q.K {
+			hits = hits[:q.K]
+		}
+		res.Estates = hits
+	} else {
+		res.Estates = estateSearchIndex.nearest(q.Center, q.K, &q.estateFilter)
+		res.Count = int64(len(res.Estates))
+	}
+	if res.Estates == nil {
+		res.Estates = []EstateWithDistance{}
+	}
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const orderStatusCompleted = "completed"
+
+// ordersLimit 1回に返す購入記録の上限。新しいものから返す
+const ordersLimit = 100
+
+// Order 椅子の購入記録
+type Order struct {
+	ID        int64     `db:"id" json:"id"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Price     int64     `db:"price" json:"price"`
+	Status    string    `db:"status" json:"status"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+type OrderListResponse struct {
+	Orders []Order `json:"orders"`
+}
+
+// getOrders 購入者のメールアドレスが入るので、adminGuardを通ったものだけに返す
+func getOrders(c echo.Context) error {
+	email := c.QueryParam("email")
+	if email == "" {
+		return errInvalidParam(&paramError{Field: "email", Reason: "required"})
+	}
+
+	orders := []Order{}
+	query := `SELECT id,chair_id,email,price,status,created_at FROM orders WHERE email=? ORDER BY created_at DESC, id DESC LIMIT ?`
+	start := time.Now()
+	err := chairDb.SelectContext(c.Request().Context(), &orders, query, email, ordersLimit)
+	observeQuery("orders_by_email", start)
+	if err != nil {
+		return errInternal(err)
+	}
+	return JSON(c, http.StatusOK, OrderListResponse{Orders: orders})
+}
+
+func getOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errInvalidID("id")
+	}
+
+	var order Order
+	query := `SELECT id,chair_id,email,price,status,created_at FROM orders WHERE id=?`
+	start := time.Now()
+	err = chairDb.GetContext(c.Request().Context(), &order, query, id)
+	observeQuery("order_by_id", start)
+	if err == sql.ErrNoRows {
+		return errNotFound("order")
+	} else if err != nil {
+		return errInternal(err)
+	}
+	return JSON(c, http.StatusOK, order)
+}
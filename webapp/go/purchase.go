@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errChairNotFound = errors.New("chair not found")
+	errOutOfStock    = errors.New("chair is out of stock")
+)
+
+// chairSwapMux chairMapの比較と置き換えを不可分にする
+var chairSwapMux sync.Mutex
+
+// compareAndSwapChair chairMapの値がoldのままであればnewに置き換える
+func compareAndSwapChair(old, new Chair) bool {
+	chairSwapMux.Lock()
+	defer chairSwapMux.Unlock()
+	cur, ok := chairMap.Load(old.ID)
+	if !ok || cur.(Chair) != old {
+		return false
+	}
+	chairMap.Store(new.ID, new)
+	return true
+}
+
+// lowerChairStock 在庫は減る方向にしか変化しないので、キャッシュがstockより多いときだけ反映する
+func lowerChairStock(id, stock int64) {
+	for {
+		cur, ok := chairMap.Load(id)
+		if !ok {
+			return
+		}
+		old := cur.(Chair)
+		if old.Stock <= stock {
+			return
+		}
+		next := old
+		next.Stock = stock
+		if compareAndSwapChair(old, next) {
+			return
+		}
+	}
+}
+
+// purchaseChair 在庫を1つ確保して購入記録を残す。売り切れならerrOutOfStockを返す
+func purchaseChair(ctx context.Context, id int64, email string) (Order, error) {
+	if cur, ok := chairMap.Load(id); !ok {
+		return Order{}, errChairNotFound
+	} else if cur.(Chair).Stock <= 0 {
+		return Order{}, errOutOfStock
+	}
+
+	tx, err := chairDb.BeginTxx(ctx, nil)
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	start := time.Now()
+	err = tx.GetContext(ctx, &chair, "SELECT id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock FROM chair WHERE id=? FOR UPDATE", id)
+	observeQuery("purchase_lock_chair", start)
+	if err == sql.ErrNoRows {
+		return Order{}, errChairNotFound
+	} else if err != nil {
+		return Order{}, err
+	}
+	if chair.Stock <= 0 {
+		lowerChairStock(id, 0)
+		chairSearchIndex.lowerStock(id, 0)
+		return Order{}, errOutOfStock
+	}
+
+	start = time.Now()
+	_, err = tx.ExecContext(ctx, "UPDATE chair SET stock=stock-1 WHERE id=?", id)
+	observeQuery("purchase_update_stock", start)
+	if err != nil {
+		return Order{}, err
+	}
+	order := Order{
+		ChairID:   chair.ID,
+		Email:     email,
+		Price:     chair.Price,
+		Status:    orderStatusCompleted,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	start = time.Now()
+	res, err := tx.ExecContext(ctx, "INSERT INTO orders(chair_id,email,price,status,created_at) VALUES (?,?,?,?,?)", order.ChairID, order.Email, order.Price, order.Status, order.CreatedAt)
+	observeQuery("purchase_insert_order", start)
+	if err != nil {
+		return Order{}, err
+	}
+	if order.ID, err = res.LastInsertId(); err != nil {
+		return Order{}, err
+	}
+	start = time.Now()
+	err = tx.Commit()
+	observeQuery("purchase_commit", start)
+	if err != nil {
+		return Order{}, err
+	}
+	lowerChairStock(id, chair.Stock-1)
+	chairSearchIndex.lowerStock(id, chair.Stock-1)
+	if chair.Stock-1 == 0 {
+		// 売り切れた椅子はおすすめから外れる
+		resetRecommendChair()
+	}
+	return order, nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	// queryExampleMaxLen ダイジェストと遅いクエリのログに残すSQLの長さ
+	queryExampleMaxLen = 1024
+	// fingerprintCacheMaxLen これより長いクエリ(バルクINSERTなど)は正規化の結果を覚えておかない
+	fingerprintCacheMaxLen = 4096
+)
+
+// slowQueryThreshold これより時間のかかったクエリをログに出す。SLOW_QUERY_THRESHOLDで変更でき、0で出さない
+var slowQueryThreshold = 100 * time.Millisecond
+
+// openTimedDB 全てのクエリの時間と行数を記録するドライバでMySQLに繋ぐ
+func openTimedDB(name, dsn string) (*sqlx.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// sqlxのプレースホルダの種類はドライバ名で決まるので"mysql"のままにする
+	return sqlx.NewDb(sql.OpenDB(&timedConnector{Connector: connector, db: name}), "mysql"), nil
+}
+
+type timedConnector struct {
+	driver.Connector
+	db string
+}
+
+func (c *timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn: conn, db: c.db}, nil
+}
+
+// timedConn mysqlConnが実装しているインターフェースをそのまま中継する
+type timedConn struct {
+	conn driver.Conn
+	db   string
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	stmt, err := c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		recordQuery(ctx, c.db, query, time.Since(start), 0)
+		return nil, err
+	}
+	return &timedStmt{stmt: stmt, ctx: ctx, db: c.db, query: query, prepare: time.Since(start)}, nil
+}
+
+func (c *timedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *timedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		// 引数付きのクエリはdatabase/sqlがPrepare, 実行, Closeとやり直すので、そちらで往復の分も含めて記録する
+		return nil, err
+	}
+	recordExec(ctx, c.db, query, start, res, err)
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	if err != nil {
+		recordQuery(ctx, c.db, query, time.Since(start), 0)
+		return nil, err
+	}
+	return &timedRows{rows: rows, ctx: ctx, db: c.db, query: query, start: start}, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	return c.conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+// timedStmt Prepareにかかった時間は最初の実行に、Closeにかかった時間は同じクエリの合計に足す。
+// database/sqlは1つのStmtを同時に使わないのでロックはいらない
+type timedStmt struct {
+	stmt    driver.Stmt
+	ctx     context.Context
+	db      string
+	query   string
+	prepare time.Duration
+}
+
+func (s *timedStmt) Close() error {
+	start := time.Now()
+	err := s.stmt.Close()
+	elapsed := time.Since(start)
+	queryDigest.addTime(s.db, s.query, elapsed)
+	addDBTime(s.ctx, elapsed)
+	return err
+}
+
+// started 実行を始めた時刻。まだ数えていないPrepareの時間があれば、その分だけ前にずらす
+func (s *timedStmt) started() time.Time {
+	start := time.Now().Add(-s.prepare)
+	s.prepare = 0
+	return start
+}
+
+func (s *timedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+// Exec, Query database/sqlはStmtExecContextとStmtQueryContextを優先して使う
+func (s *timedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.stmt.Exec(args)
+}
+
+func (s *timedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.stmt.Query(args)
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := s.started()
+	res, err := s.stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	recordExec(ctx, s.db, s.query, start, res, err)
+	return res, err
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := s.started()
+	rows, err := s.stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		recordQuery(ctx, s.db, s.query, time.Since(start), 0)
+		return nil, err
+	}
+	return &timedRows{rows: rows, ctx: ctx, db: s.db, query: s.query, start: start}, nil
+}
+
+// timedRows 結果を読み終えてCloseされるまでをクエリの時間とする
+type timedRows struct {
+	rows  driver.Rows
+	ctx   context.Context
+	db    string
+	query string
+	start time.Time
+	n     int64
+	done  bool
+}
+
+func (r *timedRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	err := r.rows.Next(dest)
+	if err == nil {
+		r.n++
+	}
+	return err
+}
+
+func (r *timedRows) Close() error {
+	err := r.rows.Close()
+	if !r.done {
+		r.done = true
+		recordQuery(r.ctx, r.db, r.query, time.Since(r.start), r.n)
+	}
+	return err
+}
+
+func recordExec(ctx context.Context, db, query string, start time.Time, res driver.Result, err error) {
+	elapsed := time.Since(start)
+	var rows int64
+	if err == nil && res != nil {
+		rows, _ = res.RowsAffected()
+	}
+	recordQuery(ctx, db, query, elapsed, rows)
+}
+
+func recordQuery(ctx context.Context, db, query string, elapsed time.Duration, rows int64) {
+	queryDigest.add(db, query, elapsed, rows)
+	addDBTime(ctx, elapsed)
+	if slowQueryThreshold > 0 && elapsed >= slowQueryThreshold {
+		log.Printf("slow query: db=%s time=%.3fms rows=%d query=%s", db, float64(elapsed.Microseconds())/1000, rows, truncateQuery(query))
+	}
+}
+
+func truncateQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > queryExampleMaxLen {
+		return query[:queryExampleMaxLen] + "..."
+	}
+	return query
+}
+
+var (
+	placeholderListRe = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valuesListRe      = regexp.MustCompile(`(values\s*\(\?\+\))(?:\s*,\s*\(\?\+\))+`)
+)
+
+var fingerprintCache sync.Map
+
+// fingerprint pt-query-digestのようにリテラルを?にし、空白と大文字小文字を揃え、値のリストを(?+)にまとめる
+func fingerprint(query string) string {
+	if len(query) <= fingerprintCacheMaxLen {
+		if fp, ok := fingerprintCache.Load(query); ok {
+			return fp.(string)
+		}
+	}
+
+	b := strings.Builder{}
+	b.Grow(len(query))
+	space := false
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"':
+			// 文字列リテラルを読み飛ばす
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' {
+					i++
+				} else if query[i] == ch {
+					break
+				}
+			}
+			ch = '?'
+		case ch == '`':
+			end := len(query)
+			if j := strings.IndexByte(query[i+1:], '`'); j >= 0 {
+				end = i + j + 2
+			}
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteString(query[i:end])
+			i = end - 1
+			continue
+		case ch >= '0' && ch <= '9' && !precededByIdent(query, i):
+			for i+1 < len(query) && (isDigit(query[i+1]) || query[i+1] == '.' || query[i+1] == 'e' || query[i+1] == 'E') {
+				i++
+			}
+			ch = '?'
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			space = true
+			continue
+		case ch >= 'A' && ch <= 'Z':
+			ch += 'a' - 'A'
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(ch)
+	}
+
+	fp := placeholderListRe.ReplaceAllString(b.String(), "(?+)")
+	fp = valuesListRe.ReplaceAllString(fp, "$1")
+	if len(query) <= fingerprintCacheMaxLen {
+		fingerprintCache.Store(query, fp)
+	}
+	return fp
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func precededByIdent(s string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	p := s[i-1]
+	return p == '_' || isDigit(p) || (p >= 'a' && p <= 'z') || (p >= 'A' && p <= 'Z')
+}
+
+// QueryStat 同じフィンガープリントのクエリの集計
+type QueryStat struct {
+	DB          string  `json:"db"`
+	Fingerprint string  `json:"fingerprint"`
+	Example     string  `json:"example"`
+	Count       int64   `json:"count"`
+	TotalMs     float64 `json:"totalMs"`
+	AvgMs       float64 `json:"avgMs"`
+	MaxMs       float64 `json:"maxMs"`
+	Rows        int64   `json:"rows"`
+	AvgRows     float64 `json:"avgRows"`
+
+	total time.Duration
+	max   time.Duration
+}
+
+type queryDigestStore struct {
+	mu    sync.Mutex
+	stats map[string]*QueryStat
+	since time.Time
+}
+
+var queryDigest = &queryDigestStore{stats: map[string]*QueryStat{}, since: time.Now()}
+
+func (d *queryDigestStore) add(db, query string, elapsed time.Duration, rows int64) {
+	fp := fingerprint(query)
+	key := db + "\x00" + fp
+	d.mu.Lock()
+	s, ok := d.stats[key]
+	if !ok {
+		s = &QueryStat{DB: db, Fingerprint: fp}
+		d.stats[key] = s
+	}
+	s.Count++
+	s.total += elapsed
+	s.Rows += rows
+	slowest := elapsed >= s.max
+	if slowest {
+		s.max = elapsed
+	}
+	d.mu.Unlock()
+
+	if slowest {
+		// 一番遅かったものを例として残す。/initializeの数MBのINSERTを抱え続けないよう、切り詰めてから持つ
+		example := truncateQuery(query)
+		d.mu.Lock()
+		if s.max == elapsed {
+			s.Example = example
+		}
+		d.mu.Unlock()
+	}
+}
+
+// addTime 実行回数を増やさずに時間だけ足す
+func (d *queryDigestStore) addTime(db, query string, elapsed time.Duration) {
+	key := db + "\x00" + fingerprint(query)
+	d.mu.Lock()
+	if s, ok := d.stats[key]; ok {
+		s.total += elapsed
+	}
+	d.mu.Unlock()
+}
+
+func (d *queryDigestStore) reset() {
+	d.mu.Lock()
+	d.stats = map[string]*QueryStat{}
+	d.since = time.Now()
+	d.mu.Unlock()
+}
+
+// QueryDigestResponse /debug/queriesのレスポンス
+type QueryDigestResponse struct {
+	Since      time.Time   `json:"since"`
+	TotalCount int64       `json:"totalCount"`
+	TotalMs    float64     `json:"totalMs"`
+	Queries    []QueryStat `json:"queries"`
+}
+
+func (d *queryDigestStore) top(n int, sortBy string) QueryDigestResponse {
+	res := QueryDigestResponse{Queries: []QueryStat{}}
+	d.mu.Lock()
+	res.Since = d.since
+	for _, s := range d.stats {
+		stat := *s
+		if len(stat.Fingerprint) > queryExampleMaxLen {
+			stat.Fingerprint = stat.Fingerprint[:queryExampleMaxLen] + "..."
+		}
+		res.Queries = append(res.Queries, stat)
+	}
+	d.mu.Unlock()
+
+	var total time.Duration
+	for i := range res.Queries {
+		s := &res.Queries[i]
+		total += s.total
+		res.TotalCount += s.Count
+		s.TotalMs = float64(s.total.Microseconds()) / 1000
+		s.MaxMs = float64(s.max.Microseconds()) / 1000
+		s.AvgMs = s.TotalMs / float64(s.Count)
+		s.AvgRows = float64(s.Rows) / float64(s.Count)
+	}
+	res.TotalMs = float64(total.Microseconds()) / 1000
+
+	less := map[string]func(a, b *QueryStat) bool{
+		"total": func(a, b *QueryStat) bool { return a.total > b.total },
+		"count": func(a, b *QueryStat) bool { return a.Count > b.Count },
+		"avg":   func(a, b *QueryStat) bool { return a.AvgMs > b.AvgMs },
+		"max":   func(a, b *QueryStat) bool { return a.max > b.max },
+		"rows":  func(a, b *QueryStat) bool { return a.Rows > b.Rows },
+	}[sortBy]
+	sort.SliceStable(res.Queries, func(i, j int) bool { return less(&res.Queries[i], &res.Queries[j]) })
+	if len(res.Queries) > n {
+		res.Queries = res.Queries[:n]
+	}
+	return res
+}
+
+// getQueryDigest 合計時間の多い順(sortで変更可)に上位n件のクエリを返す。format=textでpt-query-digest風のテキストにする
+func getQueryDigest(c echo.Context) error {
+	n := 20
+	if s := c.QueryParam("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			return errInvalidParam(&paramError{Field: "n", Reason: "must be a positive integer"})
+		}
+		n = v
+	}
+	sortBy := c.QueryParam("sort")
+	switch sortBy {
+	case "":
+		sortBy = "total"
+	case "total", "count", "avg", "max", "rows":
+	default:
+		return errInvalidParam(&paramError{Field: "sort", Reason: "must be one of total, count, avg, max, rows"})
+	}
+
+	res := queryDigest.top(n, sortBy)
+	if c.QueryParam("format") == "text" {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+		c.Response().WriteHeader(http.StatusOK)
+		writeQueryDigestText(c.Response(), res)
+		return nil
+	}
+	return JSON(c, http.StatusOK, res)
+}
+
+func writeQueryDigestText(w io.Writer, res QueryDigestResponse) {
+	b := strings.Builder{}
+	b.WriteString("# since " + res.Since.Format(time.RFC3339) + ", " + strconv.FormatInt(res.TotalCount, 10) + " queries, " + strconv.FormatFloat(res.TotalMs, 'f', 3, 64) + "ms total\n")
+	b.WriteString("# Rank  Response time       Calls     R/Call   Max      Rows/Call  DB      Query\n")
+	for i, s := range res.Queries {
+		share := 0.0
+		if res.TotalMs > 0 {
+			share = s.TotalMs / res.TotalMs * 100
+		}
+		b.WriteString(padLeft(strconv.Itoa(i+1), 6) + "  " +
+			padLeft(strconv.FormatFloat(s.TotalMs, 'f', 1, 64)+"ms", 10) + " " +
+			padLeft(strconv.FormatFloat(share, 'f', 1, 64)+"%", 6) + "  " +
+			padLeft(strconv.FormatInt(s.Count, 10), 8) + "  " +
+			padLeft(strconv.FormatFloat(s.AvgMs, 'f', 2, 64), 7) + "  " +
+			padLeft(strconv.FormatFloat(s.MaxMs, 'f', 2, 64), 7) + "  " +
+			padLeft(strconv.FormatFloat(s.AvgRows, 'f', 1, 64), 9) + "  " +
+			padRight(s.DB, 6) + "  " + s.Fingerprint + "\n")
+	}
+	io.WriteString(w, b.String())
+}
+
+func padLeft(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat(" ", n-len(s)) + s
+}
+
+func padRight(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+func deleteQueryDigest(c echo.Context) error {
+	queryDigest.reset()
+	return c.NoContent(http.StatusNoContent)
+}
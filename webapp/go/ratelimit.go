@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// rateBudget ルートごとのトークンバケットの設定。Rateは1秒あたりに戻るトークン数
+type rateBudget struct {
+	Rate  float64
+	Burst int
+}
+
+// fillTime 空のバケットが満杯に戻るまでの時間
+func (b rateBudget) fillTime() time.Duration {
+	return time.Duration(float64(b.Burst) / b.Rate * float64(time.Second))
+}
+
+// defaultRateBudgets nazotteは重いので詳細の取得よりずっと絞る
+var defaultRateBudgets = map[string]rateBudget{
+	"/api/estate/nazotte":     {Rate: 2, Burst: 5},
+	"/api/estate/near":        {Rate: 5, Burst: 10},
+	"/api/chair/search":       {Rate: 10, Burst: 20},
+	"/api/estate/search":      {Rate: 10, Burst: 20},
+	"/api/chair/buy/:id":      {Rate: 5, Burst: 10},
+	"/api/estate/req_doc/:id": {Rate: 5, Burst: 10},
+	"/api/chair/:id":          {Rate: 50, Burst: 100},
+	"/api/estate/:id":         {Rate: 50, Burst: 100},
+}
+
+// parseRateBudgets "/api/estate/nazotte=2/5,/api/chair/search=10/20"の形式を読む
+func parseRateBudgets(s string) (map[string]rateBudget, error) {
+	budgets := map[string]rateBudget{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		j := strings.LastIndex(item, "/")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("invalid rate limit %q: want route=rate/burst", item)
+		}
+		rate, err := strconv.ParseFloat(item[i+1:j], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: bad rate", item)
+		}
+		burst, err := strconv.Atoi(item[j+1:])
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: bad burst", item)
+		}
+		budgets[item[:i]] = rateBudget{Rate: rate, Burst: burst}
+	}
+	return budgets, nil
+}
+
+// rateResult バケットからトークンを取った結果。Remainingは取った後に残っているトークン数
+type rateResult struct {
+	Allowed   bool
+	Remaining float64
+}
+
+// rateLimitStore トークンバケットの置き場所。複数台で共有するなら、同じ計算をRedisなどで不可分に行う実装に差し替える
+type rateLimitStore interface {
+	take(ctx context.Context, key string, b rateBudget, now time.Time) (rateResult, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// memoryRateLimitStore プロセス内のバケット。ロックの競合を減らすためにキーで分ける
+type memoryRateLimitStore struct {
+	shards [16]memoryRateShard
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	s := &memoryRateLimitStore{}
+	for i := range s.shards {
+		s.shards[i].buckets = map[string]*tokenBucket{}
+	}
+	return s
+}
+
+func (s *memoryRateLimitStore) shard(key string) *memoryRateShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, key string, b rateBudget, now time.Time) (rateResult, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	bk, ok := sh.buckets[key]
+	if !ok {
+		bk = &tokenBucket{tokens: float64(b.Burst), last: now}
+		sh.buckets[key] = bk
+	}
+	bk.tokens = math.Min(float64(b.Burst), bk.tokens+now.Sub(bk.last).Seconds()*b.Rate)
+	bk.last = now
+	if bk.tokens < 1 {
+		return rateResult{Allowed: false, Remaining: bk.tokens}, nil
+	}
+	bk.tokens--
+	return rateResult{Allowed: true, Remaining: bk.tokens}, nil
+}
+
+// sweep しばらく使われていないバケットを捨てる。満杯に戻るだけの時間が経っていれば、捨てても結果は変わらない
+func (s *memoryRateLimitStore) sweep(idle time.Duration, now time.Time) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for k, bk := range sh.buckets {
+			if now.Sub(bk.last) > idle {
+				delete(sh.buckets, k)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// rateLimitRejections ルートごとの429の数
+var rateLimitRejections = newCounterVec()
+
+// rateLimiter ルートのテンプレートごとの予算で、クライアントごとにトークンバケットを持つ
+type rateLimiter struct {
+	store   rateLimitStore
+	budgets map[string]rateBudget
+	apiKeys map[string]bool
+}
+
+// NewRateLimiterFromEnv RATE_LIMIT=onで有効にする。ベンチマーカーは1つのアドレスから来るので既定では無効。
+// RATE_LIMIT_ROUTESでルートごとの予算を上書きし、RATE_LIMIT_API_KEYSに並べたキーはIPの代わりにキーで数える
+func NewRateLimiterFromEnv() (*rateLimiter, error) {
+	if getEnv("RATE_LIMIT", "off") != "on" {
+		return nil, nil
+	}
+	budgets := map[string]rateBudget{}
+	for k, v := range defaultRateBudgets {
+		budgets[k] = v
+	}
+	overrides, err := parseRateBudgets(os.Getenv("RATE_LIMIT_ROUTES"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range overrides {
+		budgets[k] = v
+	}
+	apiKeys := map[string]bool{}
+	for _, k := range strings.Split(os.Getenv("RATE_LIMIT_API_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			apiKeys[k] = true
+		}
+	}
+
+	store := newMemoryRateLimitStore()
+	var idle time.Duration
+	for _, b := range budgets {
+		if d := b.fillTime(); d > idle {
+			idle = d
+		}
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			store.sweep(idle, now)
+		}
+	}()
+	return &rateLimiter{store: store, budgets: budgets, apiKeys: apiKeys}, nil
+}
+
+// clientIP nginxからunixソケットかループバックで来たときだけX-Forwarded-Forを信じる。
+// nginxは$proxy_add_x_forwarded_forで末尾に接続元を足すので、いちばん右を使う
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	trusted := host == "" || host == "@" || (ip != nil && ip.IsLoopback())
+	if trusted {
+		if xff := r.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+			if i := strings.LastIndex(xff, ","); i >= 0 {
+				xff = xff[i+1:]
+			}
+			return strings.TrimSpace(xff)
+		}
+		if xrip := r.Header.Get(echo.HeaderXRealIP); xrip != "" {
+			return xrip
+		}
+	}
+	return host
+}
+
+// clientKey 登録済みのAPIキーがあればそれで、なければIPで数える。未知のキーで制限を逃れられないようにする
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if k := r.Header.Get("X-Api-Key"); k != "" && l.apiKeys[k] {
+		return "key:" + k
+	}
+	return "ip:" + clientIP(r)
+}
+
+// middleware RateLimit-*ヘッダを付け、トークンがなければRetry-After付きの429を返す
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		b, ok := l.budgets[c.Path()]
+		if !ok {
+			return next(c)
+		}
+		r := c.Request()
+		res, err := l.store.take(r.Context(), c.Path()+"|"+l.clientKey(r), b, time.Now())
+		if err != nil {
+			// 数えられないときは止めずに通す
+			log.Printf("rate limit: %v", err)
+			return next(c)
+		}
+
+		h := c.Response().Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(b.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(res.Remaining)))
+		reset := (float64(b.Burst) - res.Remaining) / b.Rate
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", b.Burst, int(math.Ceil(b.fillTime().Seconds()))))
+		if !res.Allowed {
+			rateLimitRejections.inc(labels("route", c.Path()))
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil((1-res.Remaining)/b.Rate))))
+			return &APIError{Status: http.StatusTooManyRequests, Code: "too_many_requests", Message: "rate limit exceeded"}
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+// smallestTwo 椅子の3辺のうち小さい2辺を小さい順に返す
+func (c Chair) smallestTwo() (int64, int64) {
+	w, h, d := c.Width, c.Height, c.Depth
+	if w > h {
+		w, h = h, w
+	}
+	if h > d {
+		h, d = d, h
+	}
+	if w > h {
+		w, h = h, w
+	}
+	return w, h
+}
+
+// fitsThrough 椅子がドアを通るか。recommended_estateと同じく小さい2辺で判定する
+func (c Chair) fitsThrough(e Estate) bool {
+	w, h := c.smallestTwo()
+	return (e.DoorWidth >= w && e.DoorHeight >= h) || (e.DoorWidth >= h && e.DoorHeight >= w)
+}
+
+var recommendChairCache map[int64]ChairListResponse
+var recommendChairCacheMux sync.RWMutex
+
+// recommendChairCacheGen recommendCacheGenと同じ使い方をする
+var recommendChairCacheGen uint64
+
+func resetRecommendChair() {
+	recommendChairCacheMux.Lock()
+	recommendChairCache = make(map[int64]ChairListResponse)
+	recommendChairCacheGen++
+	recommendChairCacheMux.Unlock()
+}
+
+// ranksBefore popularity DESC, id ASCでaがbより前に来るか
+func (e Estate) ranksBefore(b Estate) bool {
+	if e.Popularity != b.Popularity {
+		return e.Popularity > b.Popularity
+	}
+	return e.ID < b.ID
+}
+
+// recommend 椅子が通るドアの物件を人気順にlimit件返す
+func (ei *estateIndex) recommend(chair Chair, limit int) []Estate {
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+
+	estates := []Estate{}
+	for _, e := range ei.estates {
+		if len(estates) >= limit {
+			break
+		}
+		if chair.fitsThrough(e) {
+			estates = append(estates, e)
+		}
+	}
+	return estates
+}
+
+// invalidateRecommendCache 追加された物件で結果が変わる椅子のキャッシュだけを捨てる。
+// 判定の間も読めるように、ロックはキャッシュの写しを取るときと消すときだけ取る
+func invalidateRecommendCache(added []Estate) {
+	recommendCacheMux.Lock()
+	// 世代を進めたあとに計算した結果は追加された物件を含んでいるので、判定しなくてよい
+	recommendCacheGen++
+	cached := make(map[int]EstateListResponse, len(recommendCache))
+	for id, res := range recommendCache {
+		cached[id] = res
+	}
+	recommendCacheMux.Unlock()
+
+	var stale []int
+	for id, res := range cached {
+		if recommendationChanged(id, res, added) {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	recommendCacheMux.Lock()
+	for _, id := range stale {
+		delete(recommendCache, id)
+	}
+	recommendCacheMux.Unlock()
+}
+
+// recommendationChanged 追加された物件が椅子idのおすすめresに入ってくるか
+func recommendationChanged(id int, res EstateListResponse, added []Estate) bool {
+	val, ok := chairMap.Load(int64(id))
+	if !ok {
+		return true
+	}
+	chair := val.(Chair)
+	for _, e := range added {
+		if !chair.fitsThrough(e) {
+			continue
+		}
+		if len(res.Estates) < Limit || e.ranksBefore(res.Estates[len(res.Estates)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+type RecommendCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+func getRecommendCacheStats() RecommendCacheStats {
+	recommendCacheMux.RLock()
+	entries := len(recommendCache)
+	recommendCacheMux.RUnlock()
+	return RecommendCacheStats{
+		Entries: entries,
+		Hits:    atomic.LoadUint64(&recommendEstateCacheCounter.hits),
+		Misses:  atomic.LoadUint64(&recommendEstateCacheCounter.misses),
+	}
+}
+
+func getRecommendCacheStatus(c echo.Context) error {
+	return JSON(c, http.StatusOK, getRecommendCacheStats())
+}
+
+// recommend ドアを通る在庫のある椅子を人気順にlimit件返す
+func (ci *chairIndex) recommend(estate Estate, limit int) []Chair {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	chairs := []Chair{}
+	ci.inStock.each(func(i int) bool {
+		if ci.chairs[i].fitsThrough(estate) {
+			chairs = append(chairs, ci.chairs[i])
+		}
+		return len(chairs) < limit
+	})
+	return chairs
+}
+
+func searchRecommendedChairWithEstate(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("estateId"), 10, 64)
+	if err != nil {
+		return errInvalidID("estateId")
+	}
+
+	recommendChairCacheMux.RLock()
+	res, ok := recommendChairCache[id]
+	gen := recommendChairCacheGen
+	recommendChairCacheMux.RUnlock()
+	if ok {
+		recommendChairCacheCounter.hit()
+		return JSON(c, http.StatusOK, res)
+	}
+	recommendChairCacheCounter.miss()
+
+	val, ok := estateMap.Load(id)
+	if !ok {
+		return errNotFound("estate")
+	}
+	res = ChairListResponse{Chairs: chairSearchIndex.recommend(val.(Estate), Limit)}
+
+	recommendChairCacheMux.Lock()
+	if gen == recommendChairCacheGen {
+		recommendChairCache[id] = res
+	}
+	recommendChairCacheMux.Unlock()
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// rangeID スキーマの生成列(h,w,d,p,r)と同じ規則で値をRangeのIDに振り分ける
+func (rc RangeCondition) rangeID(v int64) (int64, bool) {
+	for _, r := range rc.Ranges {
+		if (r.Min == -1 || r.Min <= v) && (r.Max == -1 || v < r.Max) {
+			return r.ID, true
+		}
+	}
+	return 0, false
+}
+
+type rangePostings map[int64]bitset
+
+func (p rangePostings) add(rc RangeCondition, v int64, i, n int) {
+	id, ok := rc.rangeID(v)
+	if !ok {
+		return
+	}
+	if p[id] == nil {
+		p[id] = newBitset(n)
+	}
+	p[id].set(i)
+}
+
+type listPostings map[string]bitset
+
+func (p listPostings) add(key string, i, n int) {
+	if p[key] == nil {
+		p[key] = newBitset(n)
+	}
+	p[key].set(i)
+}
+
+// addSet FIND_IN_SETと同じくカンマ区切りの各要素を登録する
+func (p listPostings) addSet(set string, i, n int) {
+	if set == "" {
+		return
+	}
+	for _, f := range strings.Split(set, ",") {
+		p.add(f, i, n)
+	}
+}
+
+// chairIndex 椅子をpopularity DESC, id ASCの順に並べ、その位置で各条件のビットセットを持つ
+type chairIndex struct {
+	// buildMu addとlowerStockを直列にして、作り直しの間の更新を取りこぼさないようにする
+	buildMu sync.Mutex
+	mu      sync.RWMutex
+
+	chairs   []Chair
+	position map[int64]int
+	price    rangePostings
+	height   rangePostings
+	width    rangePostings
+	depth    rangePostings
+	kind     listPostings
+	color    listPostings
+	features listPostings
+	inStock  bitset
+}
+
+var chairSearchIndex = &chairIndex{}
+
+func sortChairs(chairs []Chair) {
+	sort.Slice(chairs, func(i, j int) bool {
+		if chairs[i].Popularity != chairs[j].Popularity {
+			return chairs[i].Popularity > chairs[j].Popularity
+		}
+		return chairs[i].ID < chairs[j].ID
+	})
+}
+
+// load chairsで置き換える。chairsは呼び出し後にインデックスが所有する
+func (ci *chairIndex) load(chairs []Chair) {
+	ci.buildMu.Lock()
+	defer ci.buildMu.Unlock()
+	ci.rebuild(chairs)
+}
+
+func (ci *chairIndex) rebuild(chairs []Chair) {
+	sortChairs(chairs)
+	n := len(chairs)
+	next := chairIndex{
+		chairs:   chairs,
+		position: make(map[int64]int, n),
+		price:    rangePostings{},
+		height:   rangePostings{},
+		width:    rangePostings{},
+		depth:    rangePostings{},
+		kind:     listPostings{},
+		color:    listPostings{},
+		features: listPostings{},
+		inStock:  newBitset(n),
+	}
+	for i, c := range chairs {
+		next.position[c.ID] = i
+		next.price.add(chairSearchCondition.Price, c.Price, i, n)
+		next.height.add(chairSearchCondition.Height, c.Height, i, n)
+		next.width.add(chairSearchCondition.Width, c.Width, i, n)
+		next.depth.add(chairSearchCondition.Depth, c.Depth, i, n)
+		next.kind.add(c.Kind, i, n)
+		next.color.add(c.Color, i, n)
+		next.features.addSet(c.Features, i, n)
+		if c.Stock > 0 {
+			next.inStock.set(i)
+		}
+	}
+
+	ci.mu.Lock()
+	ci.chairs = next.chairs
+	ci.position = next.position
+	ci.price = next.price
+	ci.height = next.height
+	ci.width = next.width
+	ci.depth = next.depth
+	ci.kind = next.kind
+	ci.color = next.color
+	ci.features = next.features
+	ci.inStock = next.inStock
+	ci.mu.Unlock()
+}
+
+// add 新しく登録された椅子を加える
+func (ci *chairIndex) add(added []Chair) {
+	ci.buildMu.Lock()
+	defer ci.buildMu.Unlock()
+	ci.mu.RLock()
+	chairs := make([]Chair, 0, len(ci.chairs)+len(added))
+	chairs = append(chairs, ci.chairs...)
+	ci.mu.RUnlock()
+	ci.rebuild(append(chairs, added...))
+}
+
+// lowerStock 購入で在庫が減ったときに呼ぶ。コミット順と前後しても在庫が増えないようにする
+func (ci *chairIndex) lowerStock(id, stock int64) {
+	ci.buildMu.Lock()
+	defer ci.buildMu.Unlock()
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	i, ok := ci.position[id]
+	if !ok || ci.chairs[i].Stock <= stock {
+		return
+	}
+	ci.chairs[i].Stock = stock
+	if stock <= 0 {
+		ci.inStock.clear(i)
+	}
+}
+
+// search 在庫のある椅子から条件に合うものの件数と、ページ分の椅子をdstに追加して返す
+func (ci *chairIndex) search(p *chairSearchParams, dst []Chair) (int64, []Chair) {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	hits := make(bitset, len(ci.inStock))
+	copy(hits, ci.inStock)
+	if p.Price != nil {
+		hits.and(ci.price[p.Price.ID])
+	}
+	if p.Height != nil {
+		hits.and(ci.height[p.Height.ID])
+	}
+	if p.Width != nil {
+		hits.and(ci.width[p.Width.ID])
+	}
+	if p.Depth != nil {
+		hits.and(ci.depth[p.Depth.ID])
+	}
+	if p.Kind != "" {
+		hits.and(ci.kind[p.Kind])
+	}
+	if p.Color != "" {
+		hits.and(ci.color[p.Color])
+	}
+	for _, f := range p.Features {
+		hits.and(ci.features[f])
+	}
+
+	for _, i := range hits.page(nil, p.Offset(), p.PerPage) {
+		dst = append(dst, ci.chairs[i])
+	}
+	return int64(hits.count()), dst
+}
+
+// estateIndex 物件をpopularity DESC, id ASCの順に並べ、その位置で各条件のビットセットを持つ
+type estateIndex struct {
+	buildMu sync.Mutex
+	mu      sync.RWMutex
+
+	estates    []Estate
+	all        bitset
+	doorHeight rangePostings
+	doorWidth  rangePostings
+	rent       rangePostings
+	features   listPostings
+	grid       estateGrid
+}
+
+var estateSearchIndex = &estateIndex{}
+
+func sortEstates(estates []Estate) {
+	sort.Slice(estates, func(i, j int) bool {
+		if estates[i].Popularity != estates[j].Popularity {
+			return estates[i].Popularity > estates[j].Popularity
+		}
+		return estates[i].ID < estates[j].ID
+	})
+}
+
+// load estatesで置き換える。estatesは呼び出し後にインデックスが所有する
+func (ei *estateIndex) load(estates []Estate) {
+	ei.buildMu.Lock()
+	defer ei.buildMu.Unlock()
+	ei.rebuild(estates)
+}
+
+func (ei *estateIndex) rebuild(estates []Estate) {
+	sortEstates(estates)
+	n := len(estates)
+	next := estateIndex{
+		estates:    estates,
+		all:        newBitset(n),
+		doorHeight: rangePostings{},
+		doorWidth:  rangePostings{},
+		rent:       rangePostings{},
+		features:   listPostings{},
+		grid:       estateGrid{},
+	}
+	for i, e := range estates {
+		next.all.set(i)
+		next.grid.add(e, i)
+		next.doorHeight.add(estateSearchCondition.DoorHeight, e.DoorHeight, i, n)
+		next.doorWidth.add(estateSearchCondition.DoorWidth, e.DoorWidth, i, n)
+		next.rent.add(estateSearchCondition.Rent, e.Rent, i, n)
+		next.features.addSet(e.Features, i, n)
+	}
+
+	ei.mu.Lock()
+	ei.estates = next.estates
+	ei.all = next.all
+	ei.doorHeight = next.doorHeight
+	ei.doorWidth = next.doorWidth
+	ei.rent = next.rent
+	ei.features = next.features
+	ei.grid = next.grid
+	ei.mu.Unlock()
+}
+
+// add 新しく登録された物件を加える
+func (ei *estateIndex) add(added []Estate) {
+	ei.buildMu.Lock()
+	defer ei.buildMu.Unlock()
+	ei.mu.RLock()
+	estates := make([]Estate, 0, len(ei.estates)+len(added))
+	estates = append(estates, ei.estates...)
+	ei.mu.RUnlock()
+	ei.rebuild(append(estates, added...))
+}
+
+// match 条件に合う物件の位置の集合を返す。ei.muのロックを持って呼ぶ
+func (ei *estateIndex) match(f *estateFilter) bitset {
+	hits := make(bitset, len(ei.all))
+	copy(hits, ei.all)
+	if f.DoorHeight != nil {
+		hits.and(ei.doorHeight[f.DoorHeight.ID])
+	}
+	if f.DoorWidth != nil {
+		hits.and(ei.doorWidth[f.DoorWidth.ID])
+	}
+	if f.Rent != nil {
+		hits.and(ei.rent[f.Rent.ID])
+	}
+	for _, feature := range f.Features {
+		hits.and(ei.features[feature])
+	}
+	return hits
+}
+
+// search 条件に合う物件の件数と、ページ分の物件をdstに追加して返す
+func (ei *estateIndex) search(p *estateSearchParams, dst []Estate) (int64, []Estate) {
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+
+	hits := ei.match(&p.estateFilter)
+	for _, i := range hits.page(nil, p.Offset(), p.PerPage) {
+		dst = append(dst, ei.estates[i])
+	}
+	return int64(hits.count()), dst
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 以下はMySQLで検索していたときのSQLと同じ結果を返す素朴な実装。
+// 範囲のIDは0_Schema.sqlの生成列(h,w,d,p,r)のCASE式をそのまま写している
+
+func sqlBucket(v int64, bounds ...int64) int64 {
+	for i, b := range bounds {
+		if v < b {
+			return int64(i)
+		}
+	}
+	return int64(len(bounds))
+}
+
+func sqlSizeBucket(v int64) int64  { return sqlBucket(v, 80, 110, 150) }
+func sqlPriceBucket(v int64) int64 { return sqlBucket(v, 3000, 6000, 9000, 12000, 15000) }
+func sqlRentBucket(v int64) int64  { return sqlBucket(v, 50000, 100000, 150000) }
+
+// findInSet FIND_IN_SET(s,set)>0
+func findInSet(s, set string) bool {
+	for _, f := range strings.Split(set, ",") {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlPage ORDER BY popularity DESC, id ASC LIMIT perPage OFFSET page*perPage
+func sqlPage(n int, p pagination) (int, int) {
+	from := p.Offset()
+	if from > n {
+		from = n
+	}
+	to := from + p.PerPage
+	if to > n {
+		to = n
+	}
+	return from, to
+}
+
+func sqlSearchChairs(chairs []Chair, p *chairSearchParams) (int64, []Chair) {
+	var hits []Chair
+	for _, c := range chairs {
+		if p.Price != nil && sqlPriceBucket(c.Price) != p.Price.ID ||
+			p.Height != nil && sqlSizeBucket(c.Height) != p.Height.ID ||
+			p.Width != nil && sqlSizeBucket(c.Width) != p.Width.ID ||
+			p.Depth != nil && sqlSizeBucket(c.Depth) != p.Depth.ID ||
+			p.Kind != "" && c.Kind != p.Kind ||
+			p.Color != "" && c.Color != p.Color ||
+			c.Stock <= 0 {
+			continue
+		}
+		ok := true
+		for _, f := range p.Features {
+			ok = ok && findInSet(f, c.Features)
+		}
+		if ok {
+			hits = append(hits, c)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Popularity != hits[j].Popularity {
+			return hits[i].Popularity > hits[j].Popularity
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	from, to := sqlPage(len(hits), p.pagination)
+	return int64(len(hits)), hits[from:to]
+}
+
+func sqlSearchEstates(estates []Estate, p *estateSearchParams) (int64, []Estate) {
+	var hits []Estate
+	for _, e := range estates {
+		if p.DoorHeight != nil && sqlSizeBucket(e.DoorHeight) != p.DoorHeight.ID ||
+			p.DoorWidth != nil && sqlSizeBucket(e.DoorWidth) != p.DoorWidth.ID ||
+			p.Rent != nil && sqlRentBucket(e.Rent) != p.Rent.ID {
+			continue
+		}
+		ok := true
+		for _, f := range p.Features {
+			ok = ok && findInSet(f, e.Features)
+		}
+		if ok {
+			hits = append(hits, e)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Popularity != hits[j].Popularity {
+			return hits[i].Popularity > hits[j].Popularity
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	from, to := sqlPage(len(hits), p.pagination)
+	return int64(len(hits)), hits[from:to]
+}
+
+// randomValue 半分は範囲の境目の前後から選ぶ
+func randomValue(r *rand.Rand, min, max int64, bounds ...int64) int64 {
+	if r.Intn(2) == 0 {
+		b := bounds[r.Intn(len(bounds))]
+		return b - int64(r.Intn(2))
+	}
+	return min + r.Int63n(max-min)
+}
+
+func randomFeatures(r *rand.Rand, list []string) string {
+	fs := []string{}
+	for _, i := range r.Perm(len(list))[:r.Intn(4)] {
+		fs = append(fs, list[i])
+	}
+	return strings.Join(fs, ",")
+}
+
+func randomChairs(r *rand.Rand, n int) []Chair {
+	chairs := make([]Chair, n)
+	for i, id := range r.Perm(n) {
+		chairs[i] = Chair{
+			ID:         int64(id + 1),
+			Price:      randomValue(r, 1000, 20000, 3000, 6000, 9000, 12000, 15000),
+			Height:     randomValue(r, 50, 200, 80, 110, 150),
+			Width:      randomValue(r, 50, 200, 80, 110, 150),
+			Depth:      randomValue(r, 50, 200, 80, 110, 150),
+			Kind:       chairSearchCondition.Kind.List[r.Intn(len(chairSearchCondition.Kind.List))],
+			Color:      chairSearchCondition.Color.List[r.Intn(len(chairSearchCondition.Color.List))],
+			Features:   randomFeatures(r, chairSearchCondition.Feature.List),
+			Popularity: r.Int63n(20),
+			Stock:      r.Int63n(3),
+		}
+	}
+	return chairs
+}
+
+func randomEstates(r *rand.Rand, n int) []Estate {
+	estates := make([]Estate, n)
+	for i, id := range r.Perm(n) {
+		estates[i] = Estate{
+			ID:         int64(id + 1),
+			Rent:       randomValue(r, 10000, 200000, 50000, 100000, 150000),
+			DoorHeight: randomValue(r, 50, 200, 80, 110, 150),
+			DoorWidth:  randomValue(r, 50, 200, 80, 110, 150),
+			Features:   randomFeatures(r, estateSearchCondition.Feature.List),
+			Popularity: r.Int63n(20),
+		}
+	}
+	return estates
+}
+
+func randomRange(r *rand.Rand, rc RangeCondition) *Range {
+	if r.Intn(3) != 0 {
+		return nil
+	}
+	return rc.Ranges[r.Intn(len(rc.Ranges))]
+}
+
+func randomItem(r *rand.Rand, lc ListCondition) string {
+	if r.Intn(3) != 0 {
+		return ""
+	}
+	return lc.List[r.Intn(len(lc.List))]
+}
+
+func randomFeatureList(r *rand.Rand, lc ListCondition) []string {
+	if r.Intn(3) != 0 {
+		return nil
+	}
+	fs := []string{}
+	for _, i := range r.Perm(len(lc.List))[:1+r.Intn(2)] {
+		fs = append(fs, lc.List[i])
+	}
+	return fs
+}
+
+func randomPagination(r *rand.Rand) pagination {
+	return pagination{Page: r.Intn(4), PerPage: []int{1, 5, 25}[r.Intn(3)]}
+}
+
+func copyChairs(chairs []Chair) []Chair {
+	return append([]Chair{}, chairs...)
+}
+
+func checkChairSearch(t *testing.T, ci *chairIndex, chairs []Chair, r *rand.Rand) {
+	t.Helper()
+	for n := 0; n < 2000; n++ {
+		p := chairSearchParams{
+			Price:      randomRange(r, chairSearchCondition.Price),
+			Height:     randomRange(r, chairSearchCondition.Height),
+			Width:      randomRange(r, chairSearchCondition.Width),
+			Depth:      randomRange(r, chairSearchCondition.Depth),
+			Kind:       randomItem(r, chairSearchCondition.Kind),
+			Color:      randomItem(r, chairSearchCondition.Color),
+			Features:   randomFeatureList(r, chairSearchCondition.Feature),
+			pagination: randomPagination(r),
+		}
+		wantCount, want := sqlSearchChairs(chairs, &p)
+		gotCount, got := ci.search(&p, nil)
+		if gotCount != wantCount || !equalChairs(got, want) {
+			t.Fatalf("search(%+v) = %d %v, want %d %v", p, gotCount, chairIDs(got), wantCount, chairIDs(want))
+		}
+	}
+}
+
+func equalChairs(a, b []Chair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func chairIDs(chairs []Chair) []int64 {
+	ids := make([]int64, 0, len(chairs))
+	for _, c := range chairs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func TestChairIndexMatchesSQL(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	chairs := randomChairs(r, 1000)
+	ci := &chairIndex{}
+	ci.load(copyChairs(chairs))
+	checkChairSearch(t, ci, chairs, r)
+}
+
+func TestChairIndexAddAndLowerStock(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	chairs := randomChairs(r, 1000)
+	ci := &chairIndex{}
+	ci.load(copyChairs(chairs[:600]))
+	ci.add(copyChairs(chairs[600:]))
+
+	for _, i := range r.Perm(len(chairs))[:300] {
+		c := &chairs[i]
+		if c.Stock == 0 {
+			continue
+		}
+		c.Stock--
+		ci.lowerStock(c.ID, c.Stock)
+		// 古い在庫での呼び出しが後から来ても在庫は増えない
+		ci.lowerStock(c.ID, c.Stock+1)
+	}
+	checkChairSearch(t, ci, chairs, r)
+}
+
+func TestEstateIndexMatchesSQL(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	estates := randomEstates(r, 1000)
+	ei := &estateIndex{}
+	ei.load(append([]Estate{}, estates[:600]...))
+	ei.add(append([]Estate{}, estates[600:]...))
+
+	for n := 0; n < 2000; n++ {
+		p := estateSearchParams{
+			estateFilter: estateFilter{
+				DoorHeight: randomRange(r, estateSearchCondition.DoorHeight),
+				DoorWidth:  randomRange(r, estateSearchCondition.DoorWidth),
+				Rent:       randomRange(r, estateSearchCondition.Rent),
+				Features:   randomFeatureList(r, estateSearchCondition.Feature),
+			},
+			pagination: randomPagination(r),
+		}
+		wantCount, want := sqlSearchEstates(estates, &p)
+		gotCount, got := ei.search(&p, nil)
+		same := gotCount == wantCount && len(got) == len(want)
+		for i := 0; same && i < len(got); i++ {
+			same = got[i] == want[i]
+		}
+		if !same {
+			t.Fatalf("search(%+v) = %d %v, want %d %v", p, gotCount, got, wantCount, want)
+		}
+	}
+}
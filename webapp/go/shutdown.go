@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// envUpgradePPID SIGHUPで起動した新しいプロセスに、ソケットを渡した親のPIDを伝える
+const envUpgradePPID = "UPGRADE_PPID"
+
+// shutdownTimeout 処理中のリクエストを待つ時間。SHUTDOWN_TIMEOUTで変更できる
+var shutdownTimeout = 10 * time.Second
+
+// pendingWrites 書き出し中のスナップショット、資料請求の送信、冪等キーの保存など、終了前に待つ書き込み
+var pendingWrites sync.WaitGroup
+
+// serve 各リスナーでリクエストを受け、シグナルを待つ。
+// SIGTERM, SIGINT, SIGQUITで処理中のリクエストを待ってから終了し、SIGHUPで新しいバイナリを起動してソケットを引き継ぐ。
+// SIGHUPで起動されたプロセスは、loadedが閉じるまで受け付けず、その間は親が受け続ける。
+// そうでなければ受け付けを始めた時点でsystemdに準備ができたと伝える
+func serve(e *echo.Echo, ls listenerSet, loaded <-chan struct{}) error {
+	e.Server.Handler = e
+	e.Server.ErrorLog = e.StdLogger
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	ppid := upgradeParent()
+	if ppid != 0 {
+		// 同じソケットでacceptすると、読み込み中の503が親の応答に混ざる
+		if err := waitLoaded(loaded, sig); err != nil {
+			// 親が受け続けるのでソケットは残す
+			shutdown(e, ls, true)
+			return nil
+		}
+	}
+
+	serveErr := make(chan error, len(ls.listeners))
+	for _, l := range ls.listeners {
+		go func(l net.Listener) {
+			serveErr <- e.Server.Serve(l)
+		}(l)
+	}
+	if ppid != 0 {
+		takeOver(ppid)
+	} else {
+		// 読み込みはMySQLの状態しだいで終わらないことがあるので待たない。読み込み中はrequireReadyが503を返す
+		sdNotify("READY=1")
+	}
+
+	var child *os.Process
+	childExited := make(chan error, 1)
+	for {
+		select {
+		case err := <-serveErr:
+			if err == http.ErrServerClosed {
+				continue
+			}
+			shutdown(e, ls, false)
+			return err
+		case err := <-childExited:
+			// 新しいプロセスが準備できる前に落ちたので、このまま受け続ける
+			log.Printf("upgrade: new process exited: %v", err)
+			child = nil
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				log.Printf("received %s, shutting down", s)
+				// 新しいプロセスが準備できたら親にSIGTERMを送ってくるので、ソケットは残す
+				return shutdown(e, ls, child != nil)
+			}
+			if child != nil {
+				log.Printf("upgrade: already in progress (pid %d)", child.Pid)
+				continue
+			}
+			p, err := upgrade(ls)
+			if err != nil {
+				log.Printf("upgrade: %v", err)
+				continue
+			}
+			log.Printf("upgrade: started new process (pid %d)", p.Pid)
+			child = p
+			go func() {
+				_, err := p.Wait()
+				childExited <- err
+			}()
+		}
+	}
+}
+
+// shutdown 受付を止め、処理中のリクエストと非同期の書き込みを待ってからDBを閉じる
+func shutdown(e *echo.Echo, ls listenerSet, handedOver bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, l := range ls.listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// 引き継いだ先が使い続けるのでソケットファイルを消さない
+			ul.SetUnlinkOnClose(!handedOver && !ls.systemd)
+		}
+	}
+	err := e.Server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
+	}
+	if !handedOver && !ls.systemd {
+		// 親から引き継いだソケットはClose時に消えないので、ここで消す
+		for _, l := range ls.listeners {
+			if l.Addr().Network() == "unix" {
+				os.Remove(l.Addr().String())
+			}
+		}
+	}
+
+	close(documentRequestStop)
+	if err := waitPendingWrites(ctx); err != nil {
+		// 待ちきれなかった書き込みは諦め、スナップショットとDBのCloseを優先する
+		log.Printf("shutdown: pending writes: %v", err)
+	}
+	// 次の起動でMySQLから読み直さなくて済むように、今のマップを書き出しておく
+	if !handedOver && isReady() {
+		estates, chairs := snapshotMaps()
+		if err := writeSnapshot(snapshotPath(), estates, chairs); err != nil {
+			log.Printf("snapshot: write %s: %v", snapshotPath(), err)
+		}
+	}
+
+	if accessLog != nil {
+		accessLog.Close()
+	}
+	estateDb.Close()
+	chairDb.Close()
+	return err
+}
+
+// waitPendingWrites pendingWritesが終わるかctxが切れるまで待つ
+func waitPendingWrites(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pendingWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upgrade 自分のバイナリを起動し直し、リスナーのファイルディスクリプタを渡す
+func upgrade(ls listenerSet) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	// デプロイでバイナリが置き換えられていると、/proc/self/exeは" (deleted)"付きになる
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
+	listeners := ls.listeners
+	names := make([]string, 0, len(ls.listeners)+1)
+	for range ls.listeners {
+		names = append(names, "app")
+	}
+	// 管理用のリスナーも渡さないと、新しいプロセスが同じポートで待ち受けられない
+	if ls.admin != nil {
+		listeners = append(listeners[:len(listeners):len(listeners)], ls.admin)
+		names = append(names, adminFdName)
+	}
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("cannot pass %T to new process", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	// 新しいプロセスがMySQLより速く読み込めるように、今のマップを書き出しておく
+	if isReady() {
+		estates, chairs := snapshotMaps()
+		if err := writeSnapshot(snapshotPath(), estates, chairs); err != nil {
+			log.Printf("snapshot: write %s: %v", snapshotPath(), err)
+		}
+	}
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, envUpgradePPID+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "LISTEN_FDS="+strconv.Itoa(len(files)), "LISTEN_FDNAMES="+strings.Join(names, ":"), envUpgradePPID+"="+strconv.Itoa(os.Getpid()))
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+// upgradeParent SIGHUPで起動されたプロセスであれば、ソケットを渡した親のPIDを返す
+func upgradeParent() int {
+	ppid, _ := strconv.Atoi(os.Getenv(envUpgradePPID))
+	if ppid == 0 || ppid != os.Getppid() {
+		return 0
+	}
+	return ppid
+}
+
+// errStopped 読み込みを待っている間に終了のシグナルを受けた
+var errStopped = errors.New("stopped before loading finished")
+
+// waitLoaded loadedが閉じるのを待つ。終了のシグナルを受けたらerrStoppedを返す
+func waitLoaded(loaded <-chan struct{}, sig <-chan os.Signal) error {
+	for {
+		select {
+		case <-loaded:
+			return nil
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				log.Printf("received %s before loading finished, leaving the sockets to the old process", s)
+				return errStopped
+			}
+		}
+	}
+}
+
+// takeOver 受け付けを始めたことをsystemdに伝え、親を終了させる
+func takeOver(ppid int) {
+	os.Unsetenv(envUpgradePPID)
+	// 親が終了してもsystemdがこのプロセスを止めないよう、メインプロセスを付け替える
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+		log.Printf("upgrade: stop old process (pid %d): %v", ppid, err)
+	}
+}
+
+// sdNotify Type=notifyのときにNOTIFY_SOCKETへ状態を送る
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LoadResult /initializeで流したSQLファイルごとの結果
+type LoadResult struct {
+	File       string  `json:"file"`
+	Statements int     `json:"statements"`
+	ElapsedMs  float64 `json:"elapsedMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// splitSQL rをセミコロンで文に区切ってfに渡す。クォート内のセミコロンとコメントを考慮する
+func splitSQL(r io.Reader, f func(stmt string) error) error {
+	br := bufio.NewReaderSize(r, 1024*1024)
+	stmt := bytes.Buffer{}
+	var quote rune
+	emit := func() error {
+		s := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+		if s == "" {
+			return nil
+		}
+		return f(s)
+	}
+	for {
+		ch, _, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if quote != 0 {
+			stmt.WriteRune(ch)
+			if ch == '\\' && quote != '`' {
+				next, _, err := br.ReadRune()
+				if err != nil {
+					return fmt.Errorf("unterminated quote: %v", err)
+				}
+				stmt.WriteRune(next)
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch ch {
+		case '\'', '"', '`':
+			quote = ch
+			stmt.WriteRune(ch)
+		case ';':
+			if err := emit(); err != nil {
+				return err
+			}
+		case '#':
+			if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+				return err
+			}
+			stmt.WriteByte('\n')
+		case '-':
+			if b, err := br.Peek(2); err == nil && b[0] == '-' && (b[1] == ' ' || b[1] == '\t' || b[1] == '\n') {
+				if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+					return err
+				}
+				stmt.WriteByte('\n')
+			} else {
+				stmt.WriteRune(ch)
+			}
+		case '/':
+			if b, err := br.Peek(1); err == nil && b[0] == '*' {
+				// /*!...*/はMySQLが解釈するので文に残す
+				stmt.WriteString("/*")
+				br.ReadByte()
+				for {
+					c, _, err := br.ReadRune()
+					if err != nil {
+						return fmt.Errorf("unterminated comment: %v", err)
+					}
+					stmt.WriteRune(c)
+					if c == '*' {
+						if b, err := br.Peek(1); err == nil && b[0] == '/' {
+							br.ReadByte()
+							stmt.WriteByte('/')
+							break
+						}
+					}
+				}
+			} else {
+				stmt.WriteRune(ch)
+			}
+		default:
+			stmt.WriteRune(ch)
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated quote %q", quote)
+	}
+	return emit()
+}
+
+func isDatabaseStatement(stmt string) bool {
+	fields := strings.Fields(strings.ToUpper(stmt))
+	return len(fields) >= 2 && (fields[0] == "DROP" || fields[0] == "CREATE") && (fields[1] == "DATABASE" || fields[1] == "SCHEMA")
+}
+
+// loadSQLFile pathのSQLを1本のコネクションで順に実行する
+func loadSQLFile(ctx context.Context, db *sqlx.DB, dbName, path string) LoadResult {
+	res := LoadResult{File: filepath.Base(path)}
+	start := time.Now()
+	defer func() { res.ElapsedMs = float64(time.Since(start).Microseconds()) / 1000 }()
+
+	f, err := os.Open(path)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer f.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer conn.Close()
+
+	err = splitSQL(f, func(stmt string) error {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("statement %d: %v", res.Statements+1, err)
+		}
+		res.Statements++
+		// DROP DATABASEで選択中のDBが外れるので選び直す
+		if isDatabaseStatement(stmt) {
+			conn.ExecContext(ctx, "USE `"+dbName+"`")
+		}
+		return nil
+	})
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// loadSQLFileCLI INITIALIZE_LOADER=cliのときだけmysqlコマンドで流す。パスワードは環境変数で渡す
+func loadSQLFileCLI(ctx context.Context, env MySQLConnectionEnv, path string) LoadResult {
+	res := LoadResult{File: filepath.Base(path)}
+	start := time.Now()
+	defer func() { res.ElapsedMs = float64(time.Since(start).Microseconds()) / 1000 }()
+
+	f, err := os.Open(path)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer f.Close()
+
+	cmd := exec.CommandContext(ctx, "mysql", "--defaults-file=/dev/null", "-h", env.Host, "-P", env.Port, "-u", env.User, env.DBName)
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+env.Password)
+	cmd.Stdin = f
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		res.Error = strings.TrimSpace(fmt.Sprintf("%v: %s", err, stderr.String()))
+	}
+	return res
+}
+
+func loadSQLFiles(ctx context.Context, db *sqlx.DB, env MySQLConnectionEnv, paths []string) ([]LoadResult, error) {
+	useCLI := getEnv("INITIALIZE_LOADER", "go") == "cli"
+	results := make([]LoadResult, 0, len(paths))
+	for _, p := range paths {
+		var res LoadResult
+		if useCLI {
+			res = loadSQLFileCLI(ctx, env, p)
+		} else {
+			res = loadSQLFile(ctx, db, env.DBName, p)
+		}
+		results = append(results, res)
+		if res.Error != "" {
+			return results, fmt.Errorf("%s: %s", res.File, res.Error)
+		}
+	}
+	return results, nil
+}
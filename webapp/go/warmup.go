@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/sync/errgroup"
+)
+
+const snapshotVersion = 1
+
+// ready chairMapとestateMapの読み込みが終わったら1になる
+var ready int32
+
+// loadMu 起動時の読み込みと/initializeが同時にマップを書き換えないようにする
+var loadMu sync.Mutex
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+func setReady(v bool) {
+	if v {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+// requireReady 読み込みが終わるまでは503を返す。/initializeとヘルスチェック、管理用エンドポイントは通す
+func requireReady(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isReady() || readinessExempt[c.Path()] || strings.HasPrefix(c.Path(), "/admin/") {
+			return next(c)
+		}
+		c.Response().Header().Set("Retry-After", "1")
+		return errUnavailable("loading data")
+	}
+}
+
+// tableFingerprint スナップショットがMySQLの内容と一致するか確かめるための値
+type tableFingerprint struct {
+	Count int64 `db:"cnt"`
+	MaxID int64 `db:"max_id"`
+	Stock int64 `db:"stock"`
+}
+
+func chairFingerprint(chairs []Chair) tableFingerprint {
+	fp := tableFingerprint{Count: int64(len(chairs))}
+	for _, c := range chairs {
+		if c.ID > fp.MaxID {
+			fp.MaxID = c.ID
+		}
+		fp.Stock += c.Stock
+	}
+	return fp
+}
+
+func estateFingerprint(estates []Estate) tableFingerprint {
+	fp := tableFingerprint{Count: int64(len(estates))}
+	for _, e := range estates {
+		if e.ID > fp.MaxID {
+			fp.MaxID = e.ID
+		}
+	}
+	return fp
+}
+
+func queryFingerprints(ctx context.Context) (estate, chair tableFingerprint, err error) {
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		return estateDb.GetContext(ctx, &estate, `SELECT COUNT(*) AS cnt, COALESCE(MAX(id),0) AS max_id, 0 AS stock FROM estate`)
+	})
+	eg.Go(func() error {
+		return chairDb.GetContext(ctx, &chair, `SELECT COUNT(*) AS cnt, COALESCE(MAX(id),0) AS max_id, COALESCE(SUM(stock),0) AS stock FROM chair`)
+	})
+	err = eg.Wait()
+	return
+}
+
+// snapshot /initialize後のestateとchairをそのまま書き出したもの
+type snapshot struct {
+	Version   int
+	CreatedAt time.Time
+	Estate    tableFingerprint
+	Chair     tableFingerprint
+	Estates   []Estate
+	Chairs    []Chair
+}
+
+func snapshotPath() string {
+	return getEnv("SNAPSHOT_PATH", filepath.Join(os.TempDir(), "isuumo.snapshot"))
+}
+
+// writeSnapshot 一時ファイルに書いてからrenameするので、読み込み側が書きかけのファイルを見ることはない
+func writeSnapshot(path string, estates []Estate, chairs []Chair) error {
+	s := snapshot{
+		Version:   snapshotVersion,
+		CreatedAt: time.Now(),
+		Estate:    estateFingerprint(estates),
+		Chair:     chairFingerprint(chairs),
+		Estates:   estates,
+		Chairs:    chairs,
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(&s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s snapshot
+	if err := gob.NewDecoder(f).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return &s, nil
+}
+
+// saveSnapshot 呼び出し元がこの後スライスを使い回しても良いようにコピーしてから書き出す
+func saveSnapshot(estates []Estate, chairs []Chair) {
+	estates = append([]Estate(nil), estates...)
+	chairs = append([]Chair(nil), chairs...)
+	pendingWrites.Add(1)
+	go func() {
+		defer pendingWrites.Done()
+		path := snapshotPath()
+		if err := writeSnapshot(path, estates, chairs); err != nil {
+			log.Printf("snapshot: write %s: %v", path, err)
+		}
+	}()
+}
+
+// snapshotMaps 今のchairMapとestateMapの中身を集める
+func snapshotMaps() ([]Estate, []Chair) {
+	var estates []Estate
+	estateMap.Range(func(_, v interface{}) bool {
+		estates = append(estates, v.(Estate))
+		return true
+	})
+	var chairs []Chair
+	chairMap.Range(func(_, v interface{}) bool {
+		chairs = append(chairs, v.(Chair))
+		return true
+	})
+	return estates, chairs
+}
+
+func selectAll(ctx context.Context) ([]Estate, []Chair, error) {
+	var estates []Estate
+	var chairs []Chair
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		query := `SELECT id,name,description,thumbnail,address,latitude,longitude,rent,door_height,door_width,features,popularity FROM estate`
+		return estateDb.SelectContext(ctx, &estates, query)
+	})
+	eg.Go(func() error {
+		query := `SELECT id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock FROM chair`
+		return chairDb.SelectContext(ctx, &chairs, query)
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return estates, chairs, nil
+}
+
+// storeAll マップと検索インデックスを作り直す。estatesとchairsはインデックスが所有する
+func storeAll(estates []Estate, chairs []Chair) {
+	for _, estate := range estates {
+		estateMap.Store(estate.ID, estate)
+	}
+	estateSearchIndex.load(estates)
+	for _, chair := range chairs {
+		chairMap.Store(chair.ID, chair)
+	}
+	chairSearchIndex.load(chairs)
+}
+
+// warmStart スナップショットがMySQLと一致していればそれを、そうでなければMySQLから読み込む
+func warmStart(ctx context.Context) (string, error) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	// 先に/initializeが終わっていれば読み直す必要はない
+	if isReady() {
+		return "initialize", nil
+	}
+
+	estateFP, chairFP, err := queryFingerprints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	source := "mysql"
+	var estates []Estate
+	var chairs []Chair
+	path := snapshotPath()
+	if s, err := readSnapshot(path); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("snapshot: read %s: %v", path, err)
+		}
+	} else if s.Estate == estateFP && s.Chair == chairFP {
+		source = "snapshot"
+		estates, chairs = s.Estates, s.Chairs
+	} else {
+		log.Printf("snapshot: %s is stale (created at %s)", path, s.CreatedAt.Format(time.RFC3339))
+	}
+
+	if estates == nil {
+		estates, chairs, err = selectAll(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	storeAll(estates, chairs)
+	setReady(true)
+	return source, nil
+}
+
+// runWarmStart 読み込めるまでリトライする。失敗している間は503を返し続ける
+func runWarmStart() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		source, err := warmStart(context.Background())
+		if err == nil {
+			log.Printf("warm start: loaded from %s in %s", source, time.Since(start))
+			return
+		}
+		log.Printf("warm start: %v (retrying in %s)", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
@@ -3,6 +3,9 @@ CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.document_requests;
+DROP TABLE IF EXISTS isuumo.orders;
+DROP TABLE IF EXISTS isuumo.idempotency_keys;
 
 CREATE TABLE isuumo.estate
 (
@@ -96,6 +99,21 @@ CREATE INDEX longitude ON isuumo.estate (longitude);
 CREATE INDEX lat_log_idx ON isuumo.estate (l);
 CREATE UNIQUE INDEX popularity_id_idx ON isuumo.estate (popularity desc, id);
 
+CREATE TABLE isuumo.document_requests
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    estate_id       INTEGER         NOT NULL,
+    email           VARCHAR(256)    NOT NULL,
+    status          VARCHAR(16)     NOT NULL,
+    attempts        INTEGER         NOT NULL,
+    last_error      VARCHAR(1024)   NOT NULL,
+    next_attempt_at DATETIME(6)     NOT NULL,
+    created_at      DATETIME(6)     NOT NULL,
+    sent_at         DATETIME(6)     NULL
+);
+CREATE INDEX status_next_attempt_at_idx on isuumo.document_requests (status, next_attempt_at);
+CREATE INDEX estate_id_created_at_idx on isuumo.document_requests (estate_id, created_at);
+
 CREATE TABLE isuumo.chair
 (
     id          INTEGER         NOT NULL PRIMARY KEY,
@@ -225,6 +243,29 @@ CREATE UNIQUE INDEX idx19 on isuumo.chair(h, kind, color, stock, popularity desc
 CREATE UNIQUE INDEX idx20 on isuumo.chair(p, color, stock, popularity desc, id);
 CREATE UNIQUE INDEX idx21 on isuumo.chair(w, d, kind, color, stock, popularity desc, id);
 
+CREATE TABLE isuumo.orders
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    price       INTEGER         NOT NULL,
+    status      VARCHAR(16)     NOT NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+CREATE INDEX email_created_at_idx on isuumo.orders (email, created_at);
+CREATE INDEX chair_id_idx on isuumo.orders (chair_id);
+
+CREATE TABLE isuumo.idempotency_keys
+(
+    idempotency_key VARCHAR(255)    NOT NULL PRIMARY KEY,
+    fingerprint     CHAR(64)        NOT NULL,
+    status          INTEGER         NOT NULL,
+    content_type    VARCHAR(128)    NOT NULL,
+    body            MEDIUMBLOB      NOT NULL,
+    created_at      DATETIME(6)     NOT NULL
+);
+CREATE INDEX created_at_idx on isuumo.idempotency_keys (created_at);
+
 # SET GLOBAL slow_query_log='ON';
 # SET GLOBAL long_query_time=0;
 # SET GLOBAL slow_query_log_file='/var/log/mysql/slow.log';